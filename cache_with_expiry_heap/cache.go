@@ -0,0 +1,1607 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Sentinel errors returned by the cache, to be checked with errors.Is
+var (
+	// ErrNotFound is returned when the requested state item is not in the cache
+	ErrNotFound = errors.New("state item not found")
+
+	// ErrExpired is returned when the requested state item is present but has expired
+	ErrExpired = errors.New("state item was found as expired")
+
+	// ErrClosed is returned when using a cache after Shutdown has been called
+	ErrClosed = errors.New("cache has been shut down")
+
+	// ErrExpiredLifespan is returned when setting an item with a lifespan that
+	// would leave it already expired
+	ErrExpiredLifespan = errors.New("lifespan would store an already expired item")
+
+	// ErrCachedMissing is returned when the key was recorded by SetMissing as
+	// not existing in the backing store
+	ErrCachedMissing = errors.New("state item is cached as missing")
+
+	// ErrNoDefaultTTL is returned by SetDefault when WithDefaultTTL wasn't used
+	ErrNoDefaultTTL = errors.New("no default TTL has been configured")
+
+	// ErrLoaderPanicked is returned, wrapped with the panic's value, when a
+	// loader panics instead of returning
+	ErrLoaderPanicked = errors.New("loader panicked")
+)
+
+// neverExpires is the expiresAt of items stored without a lifespan, these are
+// kept out of the expiration heap entirely
+const neverExpires = 0
+
+type cachedItem[K comparable, V any] struct {
+	key         K
+	value       V
+	cachedAt    int64 // unix time
+	expiresAt   int64 // unix time
+	lifespan    time.Duration
+	size        int           // estimated bytes, as measured by the sizer
+	lastAccess  atomic.Int64  // unix nano, atomic as Get only holds the read lock
+	accessCount atomic.Uint64 // successful reads, atomic for the same reason
+	missing     bool          // a negative entry from SetMissing, holding no value
+	priority    int           // lower priority items are evicted first
+}
+
+type itemExpiry[K comparable] struct {
+	itemKey        K
+	unixExpiryTime int64
+	index          int
+}
+
+type expirationQueue[K comparable] []*itemExpiry[K]
+
+func (q *expirationQueue[K]) Len() int {
+	return len(*q)
+}
+func (q *expirationQueue[K]) Less(i, j int) bool {
+	return (*q)[i].unixExpiryTime < (*q)[j].unixExpiryTime
+}
+func (q *expirationQueue[K]) Swap(i, j int) {
+	(*q)[i], (*q)[j] = (*q)[j], (*q)[i]
+	(*q)[i].index = i
+	(*q)[j].index = j
+}
+func (q *expirationQueue[K]) Push(x interface{}) {
+	n := len(*q)
+	item := x.(*itemExpiry[K])
+	item.index = n
+	*q = append(*q, item)
+}
+func (q *expirationQueue[K]) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil  // allow for eventual GC
+	item.index = -1 // help prevent accidental re-use
+	*q = old[0 : n-1]
+	return item
+}
+
+// Cache is a TTL cache of values keyed by K, using a min-heap of expiry times
+// so that cleanup only ever has to look at items which are due to expire.
+// Items are spread over one or more shards, each with its own lock and heap
+type Cache[K comparable, V any] struct {
+	shards      []*cacheShard[K, V]
+	loads       flightGroup[K, V] // de-duplicates concurrent GetOrSet loads
+	refreshes   flightGroup[K, V] // de-duplicates refresh-ahead loads
+	config      config
+	clock       Clock
+	logger      Logger
+	onExpire    func(key K, value V)
+	expiryGuard func(key K, value V) (bool, time.Duration)
+	sizer       func(value V) int
+	validate    func(value V) error
+	loader      Loader[K, V]
+	refresher   Loader[K, V]
+	writer      Writer[K, V]
+	behind      *writeBehindQueue[K, V] // nil unless WithWriteBehind is used
+	reset       chan struct{}           // wakes the cleanup routine to recompute its timer
+	counters    cacheCounters
+	watchers    watchRegistry[K, V]
+	ctx         context.Context
+	cancel      context.CancelFunc
+	closed      atomic.Bool
+	maxItems    atomic.Int64 // starts as WithMaxItems, changed by Resize
+
+	cleanupRunning atomic.Bool
+	cleanupDone    chan struct{}                 // closed once the cleanup routine has exited
+	lastCleanup    atomic.Pointer[cleanupRecord] // nil until the first pass completes
+}
+
+// NewCache creates a cache and starts its cleanup routine, which runs until
+// Shutdown is called or ctx is cancelled. Cancelling ctx also expires every
+// item, running the OnExpire callback for each, whereas Shutdown simply drops
+// them. Either way the cache is then closed, returning ErrClosed
+func NewCache[K comparable, V any](ctx context.Context, opts ...Option) *Cache[K, V] {
+	return newCache[K, V](ctx, newConfig(opts))
+}
+
+// newCache creates a cache from an already resolved config
+func newCache[K comparable, V any](ctx context.Context, cfg config) *Cache[K, V] {
+	cacheCtx, cancel := context.WithCancel(ctx)
+	cache := &Cache[K, V]{
+		shards:      make([]*cacheShard[K, V], cfg.shards),
+		config:      cfg,
+		clock:       cfg.clock,
+		logger:      cfg.logger,
+		onExpire:    hookFor[func(K, V)](cfg.onExpire, "WithOnExpire"),
+		expiryGuard: hookFor[func(K, V) (bool, time.Duration)](cfg.expiryGuard, "WithExpiryGuard"),
+		sizer:       hookFor[func(V) int](cfg.sizer, "WithSizer"),
+		validate:    hookFor[func(V) error](cfg.validator, "WithValidator"),
+		loader:      hookFor[Loader[K, V]](cfg.loader, "WithLoader"),
+		refresher:   hookFor[Loader[K, V]](cfg.refreshLoader, "WithRefreshAhead"),
+		writer:      hookFor[Writer[K, V]](cfg.writer, "WithWriter"),
+		reset:       make(chan struct{}, 1),
+		cleanupDone: make(chan struct{}),
+		ctx:         cacheCtx,
+		cancel:      cancel,
+	}
+	for i := range cache.shards {
+		cache.shards[i] = newCacheShard[K, V]()
+		cache.shards[i].checked = cfg.consistencyChecks
+	}
+	if cache.loader == nil {
+		// there's nothing to refresh stale items with
+		cache.config.staleWindow = 0
+	}
+	if behind := hookFor[Writer[K, V]](cfg.behindWriter, "WithWriteBehind"); behind != nil {
+		cache.behind = newWriteBehindQueue(behind, cfg.behindMaxBatch)
+		go cache.runWriteBehind(cfg.behindInterval)
+	}
+	cache.maxItems.Store(int64(cfg.maxItems))
+	cache.cleanupRunning.Store(true)
+	go cache.startCleanup()
+	return cache
+}
+
+// Set stores value under key for the given lifespan, replacing any existing
+// item. A lifespan of zero stores the item permanently, so that it is only
+// removed by Delete or eviction, while a negative lifespan, or one under the
+// second that expiries are tracked to, returns ErrExpiredLifespan without
+// storing anything. With a writer set by WithWriter, the value is written to
+// it first and the Set fails if that write does
+func (cache *Cache[K, V]) Set(key K, value V, lifespan time.Duration) error {
+	return cache.set(key, value, lifespan, true)
+}
+
+// SetMissing records that key is known not to exist in the backing store, so
+// that for the next ttl Get returns ErrCachedMissing rather than loading it
+// again. Any item stored under key is replaced, and like any other item the
+// entry is removed by the cleanup routine once it expires
+func (cache *Cache[K, V]) SetMissing(key K, ttl time.Duration) error {
+	if err := checkLifespan(ttl); err != nil {
+		return err
+	}
+
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+
+	var zero V
+	cachedAt := cache.clock.Now().Unix()
+	cache.storeItem(shard, key, zero, cachedAt, cache.jitteredExpiry(cachedAt, ttl), ttl, true)
+	return nil
+}
+
+// SetDefault is Set using the lifespan configured with WithDefaultTTL,
+// returning ErrNoDefaultTTL if there isn't one
+func (cache *Cache[K, V]) SetDefault(key K, value V) error {
+	if cache.config.defaultTTL <= 0 {
+		return ErrNoDefaultTTL
+	}
+	return cache.Set(key, value, cache.config.defaultTTL)
+}
+
+// set is Set with the option of skipping the writer, for values which have
+// just come from the backing store
+func (cache *Cache[K, V]) set(key K, value V, lifespan time.Duration, write bool) error {
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+	return cache.setLocked(shard, key, value, lifespan, write)
+}
+
+// SetWithPriority is Set with a priority for the item, where items with a
+// lower priority are evicted first once the item cap is reached, and ties are
+// broken by the eviction policy. Items stored by Set have a priority of zero.
+// Priority only affects eviction, so it doesn't keep an item past its expiry
+func (cache *Cache[K, V]) SetWithPriority(key K, value V, lifespan time.Duration, priority int) error {
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+	if err := cache.setLocked(shard, key, value, lifespan, true); err != nil {
+		return err
+	}
+	shard.items[key].priority = priority
+	return nil
+}
+
+// SetIfAbsent stores value under key only if there is no live item there
+// already, reporting whether it did. The check and the store happen under the
+// same lock, so of many concurrent callers only one will store
+func (cache *Cache[K, V]) SetIfAbsent(key K, value V, lifespan time.Duration) (bool, error) {
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return false, ErrClosed
+	}
+	if item, exists := shard.items[key]; exists && item.live(cache.clock.Now().Unix()) {
+		return false, nil
+	}
+
+	if err := cache.setLocked(shard, key, value, lifespan, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Replace stores value under key, with a fresh lifespan, only if there is
+// already a live item there, returning ErrNotFound if there isn't so that a
+// write never creates an item
+func (cache *Cache[K, V]) Replace(key K, value V, lifespan time.Duration) error {
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+	if item, exists := shard.items[key]; !exists || !item.live(cache.clock.Now().Unix()) {
+		return ErrNotFound
+	}
+
+	return cache.setLocked(shard, key, value, lifespan, true)
+}
+
+// validateValue runs the validator set by WithValidator, if there is one
+func (cache *Cache[K, V]) validateValue(value V) error {
+	if cache.validate == nil {
+		return nil
+	}
+	return cache.validate(value)
+}
+
+// setLocked does the work of set once the shard's write lock is held,
+// validating the value so that every path which stores one is covered
+func (cache *Cache[K, V]) setLocked(shard *cacheShard[K, V], key K, value V, lifespan time.Duration, write bool) error {
+	if err := cache.validateValue(value); err != nil {
+		return err
+	}
+	if err := checkLifespan(lifespan); err != nil {
+		return err
+	}
+	if write {
+		if err := cache.writeThrough(key, value); err != nil {
+			return err
+		}
+	}
+
+	cachedAt := cache.clock.Now().Unix()
+	cache.store(shard, key, value, cachedAt, cache.jitteredExpiry(cachedAt, lifespan), lifespan)
+	if write {
+		cache.writeBehind(key, value)
+	}
+
+	return nil
+}
+
+// SetMany stores every value for the same lifespan, taking each shard's lock
+// only once. With a writer set, a failed write stops the batch, leaving any
+// values already written in place
+func (cache *Cache[K, V]) SetMany(values map[K]V, lifespan time.Duration) error {
+	byShard := make(map[*cacheShard[K, V]][]K)
+	for key, value := range values {
+		// validate everything up front, so that an invalid value stores nothing
+		if err := cache.validateValue(value); err != nil {
+			return err
+		}
+		shard := cache.shardFor(key)
+		byShard[shard] = append(byShard[shard], key)
+	}
+
+	if err := checkLifespan(lifespan); err != nil {
+		return err
+	}
+
+	cachedAt := cache.clock.Now().Unix()
+	for shard, keys := range byShard {
+		if err := cache.setManyInShard(shard, keys, values, cachedAt, lifespan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setManyInShard stores the values for keys, which all belong to shard, under
+// a single hold of its write lock
+func (cache *Cache[K, V]) setManyInShard(shard *cacheShard[K, V], keys []K, values map[K]V, cachedAt int64, lifespan time.Duration) error {
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+	for _, key := range keys {
+		if err := cache.writeThrough(key, values[key]); err != nil {
+			return err
+		}
+		// each item gets its own jitter, so the batch doesn't expire at once
+		cache.store(shard, key, values[key], cachedAt, cache.jitteredExpiry(cachedAt, lifespan), lifespan)
+		cache.writeBehind(key, values[key])
+	}
+	return nil
+}
+
+// checkLifespan returns ErrExpiredLifespan for a lifespan which would give an
+// expiry at or before the time it was set. Zero is left alone as it means the
+// item is permanent
+func checkLifespan(lifespan time.Duration) error {
+	if lifespan < 0 || (lifespan > 0 && lifespan < time.Second) {
+		return ErrExpiredLifespan
+	}
+	return nil
+}
+
+// expiryFor returns the unix expiry of an item cached at cachedAt, items with
+// no lifespan never expire
+func expiryFor(cachedAt int64, lifespan time.Duration) int64 {
+	if lifespan <= 0 {
+		return neverExpires
+	}
+	return cachedAt + int64(lifespan.Seconds())
+}
+
+// jitteredExpiry is expiryFor plus a random offset of up to the jitter set
+// with WithExpiryJitter. Permanent items are left permanent
+func (cache *Cache[K, V]) jitteredExpiry(cachedAt int64, lifespan time.Duration) int64 {
+	expiry := expiryFor(cachedAt, lifespan)
+	jitter := int64(cache.config.expiryJitter.Seconds())
+	if expiry == neverExpires || jitter <= 0 {
+		return expiry
+	}
+	return expiry + rand.Int64N(jitter+1)
+}
+
+// store inserts or replaces an item with an already computed expiry, evicting
+// to make room if needed. The caller must hold the shard's write lock
+func (cache *Cache[K, V]) store(shard *cacheShard[K, V], key K, value V, cachedAt, expiry int64, lifespan time.Duration) {
+	cache.storeItem(shard, key, value, cachedAt, expiry, lifespan, false)
+}
+
+// storeItem is store, with the option of storing a negative entry for a key
+// known to be missing. The caller must hold the shard's write lock
+func (cache *Cache[K, V]) storeItem(shard *cacheShard[K, V], key K, value V, cachedAt, expiry int64, lifespan time.Duration, missing bool) {
+	// drop any item being replaced first, so that it isn't counted against
+	// the shard's capacity
+	shard.remove(key)
+
+	size := 0
+	if cache.sizer != nil && !missing {
+		size = cache.sizer(value)
+	}
+	cache.evictForSpace(shard)
+	cache.evictForBytes(shard, size)
+
+	item := &cachedItem[K, V]{
+		key:       key,
+		value:     value,
+		cachedAt:  cachedAt,
+		expiresAt: expiry,
+		lifespan:  lifespan,
+		size:      size,
+		missing:   missing,
+	}
+	item.touch(cache.clock.Now())
+	shard.items[key] = item
+	shard.bytes += size
+	// scheduled once the item is in place, so the shard is never checked
+	// with a heap entry for an item it doesn't hold
+	cache.scheduleExpiry(shard, key, expiry)
+	cache.counters.sets.Add(1)
+	cache.notify(EventSet, item)
+}
+
+// Get returns the item stored under key. An item found to have expired is
+// evicted straight away rather than waiting for the next cleanup. If a loader
+// was set with WithLoader, a miss is instead loaded, cached and returned, and
+// an item within the stale window set by WithStaleWindow is returned as is
+// while it is reloaded in the background
+func (cache *Cache[K, V]) Get(key K) (V, error) {
+	value, err := cache.lookup(key)
+	if cache.loader == nil || !(errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired)) {
+		return value, err
+	}
+
+	if stale, ok := cache.stale(key); ok {
+		cache.refresh(key)
+		return stale, nil
+	}
+	return cache.readThrough(key)
+}
+
+// lookup is Get without read-through, only ever returning what is cached
+func (cache *Cache[K, V]) lookup(key K) (V, error) {
+	var zero V
+
+	shard := cache.shardFor(key)
+	shard.RLock()
+	if cache.closed.Load() {
+		shard.RUnlock()
+		return zero, ErrClosed
+	}
+
+	item, exists := shard.items[key]
+	if !exists {
+		shard.RUnlock()
+		cache.counters.misses.Add(1)
+		return zero, ErrNotFound
+	}
+
+	now := cache.clock.Now()
+	if item.live(now.Unix()) {
+		item.hit(now)
+		shard.RUnlock()
+		cache.counters.hits.Add(1)
+		return item.value, nil
+	}
+	if item.missing && !item.expired(now.Unix()) {
+		shard.RUnlock()
+		cache.counters.misses.Add(1)
+		return zero, ErrCachedMissing
+	}
+	shard.RUnlock()
+
+	// the read lock can't be upgraded, so re-check under the write lock in
+	// case the item was replaced by a Set in between. Items within the stale
+	// window are kept so that Get can serve them while they are refreshed.
+	// OnExpire is deferred first so that it runs after the unlock
+	var expired []*cachedItem[K, V]
+	defer func() { cache.runOnExpire(expired) }()
+	shard.Lock()
+	defer shard.Unlock()
+	now = cache.clock.Now()
+	if current, exists := shard.items[key]; exists && current.expired(cache.staleCutoff(now.Unix())) {
+		if !cache.expireItem(shard, current, now) {
+			// the expiry guard kept the item, so it is live again
+			current.hit(now)
+			cache.counters.hits.Add(1)
+			return current.value, nil
+		}
+		expired = append(expired, current)
+	}
+
+	cache.counters.misses.Add(1)
+	return zero, ErrExpired
+}
+
+// Has reports whether a live item is stored under key, without counting as a
+// hit or miss
+func (cache *Cache[K, V]) Has(key K) bool {
+	shard := cache.shardFor(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	item, exists := shard.items[key]
+	return exists && item.live(cache.clock.Now().Unix())
+}
+
+// Peek returns the live item stored under key without it counting as a hit
+// or miss, or as an access for eviction, so that inspecting the cache doesn't
+// change how it behaves
+func (cache *Cache[K, V]) Peek(key K) (V, bool) {
+	var zero V
+
+	shard := cache.shardFor(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	item, exists := shard.items[key]
+	if !exists || !item.live(cache.clock.Now().Unix()) {
+		return zero, false
+	}
+	return item.value, true
+}
+
+// ItemMetadata describes when an item was cached and when it will expire.
+// ExpiresAt is the zero time for permanent items
+type ItemMetadata struct {
+	CachedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// GetWithMetadata returns the item stored under key along with when it was
+// cached and when it expires
+func (cache *Cache[K, V]) GetWithMetadata(key K) (V, ItemMetadata, error) {
+	var zero V
+
+	shard := cache.shardFor(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	if cache.closed.Load() {
+		return zero, ItemMetadata{}, ErrClosed
+	}
+
+	item, exists := shard.items[key]
+	if !exists {
+		cache.counters.misses.Add(1)
+		return zero, ItemMetadata{}, ErrNotFound
+	}
+
+	now := cache.clock.Now()
+	if item.expired(now.Unix()) {
+		cache.counters.misses.Add(1)
+		return zero, ItemMetadata{}, ErrExpired
+	}
+	if item.missing {
+		cache.counters.misses.Add(1)
+		return zero, ItemMetadata{}, ErrCachedMissing
+	}
+	item.hit(now)
+	cache.counters.hits.Add(1)
+
+	metadata := ItemMetadata{CachedAt: time.Unix(item.cachedAt, 0)}
+	if item.expiresAt != neverExpires {
+		metadata.ExpiresAt = time.Unix(item.expiresAt, 0)
+	}
+	return item.value, metadata, nil
+}
+
+// GetMany returns the live items stored under any of keys, taking each
+// shard's read lock only once. Missing and expired keys are left out of the result
+func (cache *Cache[K, V]) GetMany(keys []K) map[K]V {
+	byShard := make(map[*cacheShard[K, V]][]K)
+	for _, key := range keys {
+		shard := cache.shardFor(key)
+		byShard[shard] = append(byShard[shard], key)
+	}
+
+	now := cache.clock.Now()
+	found := make(map[K]V, len(keys))
+	for shard, keys := range byShard {
+		shard.RLock()
+		for _, key := range keys {
+			item, exists := shard.items[key]
+			if !exists || !item.live(now.Unix()) {
+				cache.counters.misses.Add(1)
+				continue
+			}
+			item.hit(now)
+			cache.counters.hits.Add(1)
+			found[key] = item.value
+		}
+		shard.RUnlock()
+	}
+	return found
+}
+
+// GetMultiOrLoad returns the live items stored under keys, calling loader
+// once with only the keys which missed, so that a batch costs at most one
+// round trip to the backing store. Loaded values are cached for ttl and
+// merged into the result. If loader fails, the hits are returned with its error
+func (cache *Cache[K, V]) GetMultiOrLoad(keys []K, ttl time.Duration, loader func(missing []K) (map[K]V, error)) (map[K]V, error) {
+	found := cache.GetMany(keys)
+
+	var missing []K
+	seen := make(map[K]bool, len(keys))
+	for _, key := range keys {
+		if _, hit := found[key]; !hit && !seen[key] {
+			seen[key] = true
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	loaded, err := loader(missing)
+	if err != nil {
+		return found, err
+	}
+	for key, value := range loaded {
+		found[key] = value
+	}
+
+	return found, cache.SetMany(loaded, ttl)
+}
+
+// GetAndDelete atomically returns and removes the item stored under key, so
+// that only one caller can ever consume it
+func (cache *Cache[K, V]) GetAndDelete(key K) (V, error) {
+	var zero V
+
+	// OnExpire is deferred first so that it runs after the unlock
+	var expired []*cachedItem[K, V]
+	defer func() { cache.runOnExpire(expired) }()
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return zero, ErrClosed
+	}
+
+	item, exists := shard.items[key]
+	if !exists {
+		cache.counters.misses.Add(1)
+		return zero, ErrNotFound
+	}
+
+	now := cache.clock.Now()
+	if item.expired(now.Unix()) && cache.expireItem(shard, item, now) {
+		expired = append(expired, item)
+		cache.counters.misses.Add(1)
+		return zero, ErrExpired
+	}
+	shard.remove(key)
+	cache.removed(EventDelete, item)
+	if item.missing {
+		cache.counters.misses.Add(1)
+		return zero, ErrCachedMissing
+	}
+	cache.counters.hits.Add(1)
+
+	return item.value, nil
+}
+
+// GetOrSet returns the cached item if present, otherwise it calls loader and
+// caches the result. Concurrent callers missing on the same key share a single
+// call to loader, and a loader error is returned without being cached. A
+// panicking loader is returned as ErrLoaderPanicked
+func (cache *Cache[K, V]) GetOrSet(key K, lifespan time.Duration, loader func() (V, error)) (V, error) {
+	value, err := cache.lookup(key)
+	if err == nil || errors.Is(err, ErrClosed) || errors.Is(err, ErrCachedMissing) {
+		return value, err
+	}
+
+	return cache.loads.do(key, func() (V, error) {
+		value, err := loader()
+		if err != nil {
+			return value, err
+		}
+		if err := cache.Set(key, value, lifespan); err != nil {
+			return value, err
+		}
+		return value, nil
+	})
+}
+
+// GetContext is like GetOrSet, but passes a context to loader and stops
+// waiting once ctx is done, returning ctx.Err(). The load is shared with other
+// callers of the same key, so it is given a context which is never cancelled
+// and carries on in the background when any one caller gives up
+func (cache *Cache[K, V]) GetContext(ctx context.Context, key K, lifespan time.Duration, loader func(ctx context.Context) (V, error)) (V, error) {
+	value, err := cache.lookup(key)
+	if err == nil || errors.Is(err, ErrClosed) || errors.Is(err, ErrCachedMissing) {
+		return value, err
+	}
+
+	loadCtx := context.WithoutCancel(ctx)
+	return cache.loads.doContext(ctx, key, func() (V, error) {
+		value, err := loader(loadCtx)
+		if err != nil {
+			return value, err
+		}
+		if err := cache.Set(key, value, lifespan); err != nil {
+			return value, err
+		}
+		return value, nil
+	})
+}
+
+// GetSliding behaves like Get, but on a hit also pushes the item's expiry out
+// by its original lifespan. Note that a key which is read more often than its
+// lifespan will never expire, so hot keys can be kept alive indefinitely
+func (cache *Cache[K, V]) GetSliding(key K) (V, error) {
+	var zero V
+
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return zero, ErrClosed
+	}
+
+	item, exists := shard.items[key]
+	if !exists {
+		cache.counters.misses.Add(1)
+		return zero, ErrNotFound
+	}
+
+	now := cache.clock.Now().Unix()
+	if item.expired(now) {
+		cache.counters.misses.Add(1)
+		return zero, ErrExpired
+	}
+	if item.missing {
+		cache.counters.misses.Add(1)
+		return zero, ErrCachedMissing
+	}
+	cache.counters.hits.Add(1)
+
+	item.hit(cache.clock.Now())
+	if item.expiresAt != neverExpires && item.lifespan > 0 {
+		item.expiresAt = now + int64(item.lifespan.Seconds())
+		cache.scheduleExpiry(shard, key, item.expiresAt)
+	}
+
+	return item.value, nil
+}
+
+// Touch resets the expiry of a live item to extend from now without
+// replacing its value. An extend of zero or less makes the item permanent,
+// and one under a second is rounded up to a second, as expiries are tracked to
+// the second. The extend becomes the item's lifespan, renewed by GetSliding
+func (cache *Cache[K, V]) Touch(key K, extend time.Duration) error {
+	if extend > 0 {
+		// anything shorter would leave the item already expired
+		extend = max(extend, time.Second)
+	}
+	return cache.mutate(key, func(shard *cacheShard[K, V], item *cachedItem[K, V], now time.Time) error {
+		item.expiresAt = expiryFor(now.Unix(), extend)
+		item.lifespan = max(extend, 0)
+		item.touch(now)
+		cache.scheduleExpiry(shard, key, item.expiresAt)
+		return nil
+	})
+}
+
+// Expire sets a live item to expire at the given time, rather than after a
+// duration as with Touch. A time which has already passed removes the item
+// straight away, unless the expiry guard keeps it. Expiries are tracked to
+// the second, so at is truncated
+func (cache *Cache[K, V]) Expire(key K, at time.Time) error {
+	var expired []*cachedItem[K, V]
+	err := cache.mutate(key, func(shard *cacheShard[K, V], item *cachedItem[K, V], now time.Time) error {
+		if !at.After(now) {
+			if cache.expireItem(shard, item, now) {
+				expired = append(expired, item)
+			}
+			return nil
+		}
+		item.expiresAt = at.Unix()
+		item.lifespan = time.Duration(item.expiresAt-now.Unix()) * time.Second
+		cache.scheduleExpiry(shard, key, item.expiresAt)
+		return nil
+	})
+	cache.runOnExpire(expired)
+	return err
+}
+
+// Update atomically replaces the value of a live item with the result of fn,
+// keeping its expiry. If fn or the writer returns an error the item is left
+// unchanged
+func (cache *Cache[K, V]) Update(key K, fn func(value V) (V, error)) (V, error) {
+	var updated V
+	err := cache.mutate(key, func(shard *cacheShard[K, V], item *cachedItem[K, V], now time.Time) error {
+		value, err := fn(item.value)
+		if err != nil {
+			return err
+		}
+		if err := cache.replaceValue(shard, item, value); err != nil {
+			return err
+		}
+		updated = value
+		return nil
+	})
+	return updated, err
+}
+
+// upsert is Update for an item which may not exist yet. fn is passed the live
+// value and true, or the zero value and false, and whatever it returns is
+// stored under key, keeping the expiry of an existing item or for the cache's
+// default TTL if it is new, returning ErrNoDefaultTTL if there isn't one
+func (cache *Cache[K, V]) upsert(key K, fn func(value V, found bool) (V, error)) (V, error) {
+	var zero V
+
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return zero, ErrClosed
+	}
+
+	if item, exists := shard.items[key]; exists && item.live(cache.clock.Now().Unix()) {
+		value, err := fn(item.value, true)
+		if err != nil {
+			return zero, err
+		}
+		if err := cache.replaceValue(shard, item, value); err != nil {
+			return zero, err
+		}
+		return value, nil
+	}
+
+	if cache.config.defaultTTL <= 0 {
+		return zero, ErrNoDefaultTTL
+	}
+	value, err := fn(zero, false)
+	if err != nil {
+		return zero, err
+	}
+	if err := cache.setLocked(shard, key, value, cache.config.defaultTTL, true); err != nil {
+		return zero, err
+	}
+	return value, nil
+}
+
+// CompareAndSwap replaces the value of a live item with newValue only if the
+// current value deep-equals oldValue, reporting whether the swap happened.
+// The item's expiry is left alone
+func (cache *Cache[K, V]) CompareAndSwap(key K, oldValue, newValue V) (bool, error) {
+	swapped := false
+	err := cache.mutate(key, func(shard *cacheShard[K, V], item *cachedItem[K, V], now time.Time) error {
+		if !reflect.DeepEqual(item.value, oldValue) {
+			return nil
+		}
+		if err := cache.replaceValue(shard, item, newValue); err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// replaceValue swaps an item's value in place, keeping the shard's size
+// tracking in step and letting watchers know. As with Set, the value is first
+// validated and passed to any writer, and a failure leaves the item
+// unchanged. The caller must hold the shard's write lock
+func (cache *Cache[K, V]) replaceValue(shard *cacheShard[K, V], item *cachedItem[K, V], value V) error {
+	if err := cache.validateValue(value); err != nil {
+		return err
+	}
+	if err := cache.writeThrough(item.key, value); err != nil {
+		return err
+	}
+
+	item.value = value
+	if cache.sizer != nil {
+		size := cache.sizer(value)
+		shard.bytes += size - item.size
+		item.size = size
+	}
+	cache.notify(EventUpdate, item)
+	cache.writeBehind(item.key, value)
+	return nil
+}
+
+// mutate runs fn against the live item stored under key while holding its
+// shard's write lock, returning ErrNotFound or ErrExpired if there isn't one
+func (cache *Cache[K, V]) mutate(key K, fn func(shard *cacheShard[K, V], item *cachedItem[K, V], now time.Time) error) error {
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+
+	item, exists := shard.items[key]
+	if !exists {
+		return ErrNotFound
+	}
+
+	now := cache.clock.Now()
+	if item.expired(now.Unix()) {
+		return ErrExpired
+	}
+	if item.missing {
+		return ErrCachedMissing
+	}
+
+	return fn(shard, item, now)
+}
+
+// TTL returns the remaining lifetime of an item, or ErrExpired with a zero
+// duration if it has already expired. Permanent items report a zero duration
+// without an error
+func (cache *Cache[K, V]) TTL(key K) (time.Duration, error) {
+	shard := cache.shardFor(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	item, exists := shard.items[key]
+	if !exists {
+		return 0, ErrNotFound
+	}
+	if item.expiresAt == neverExpires {
+		return 0, nil
+	}
+
+	remaining := time.Unix(item.expiresAt, 0).Sub(cache.clock.Now())
+	if remaining <= 0 {
+		return 0, ErrExpired
+	}
+
+	return remaining, nil
+}
+
+// Len returns the number of live items, ignoring any that have expired but
+// have not yet been removed by the cleanup routine
+func (cache *Cache[K, V]) Len() int {
+	now := cache.clock.Now().Unix()
+	count := 0
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for _, item := range shard.items {
+			if item.live(now) {
+				count++
+			}
+		}
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Keys returns a snapshot of the keys of all live items, in no particular order
+func (cache *Cache[K, V]) Keys() []K {
+	now := cache.clock.Now().Unix()
+	var keys []K
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for key, item := range shard.items {
+			if item.live(now) {
+				keys = append(keys, key)
+			}
+		}
+		shard.RUnlock()
+	}
+	return keys
+}
+
+// TopAccessed returns the keys of the n live items which have been read the
+// most, most read first, with ties going to the most recently read
+func (cache *Cache[K, V]) TopAccessed(n int) []K {
+	if n <= 0 {
+		return nil
+	}
+
+	type entry struct {
+		key        K
+		count      uint64
+		lastAccess int64
+	}
+
+	now := cache.clock.Now().Unix()
+	var entries []entry
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for key, item := range shard.items {
+			if item.live(now) {
+				entries = append(entries, entry{key, item.accessCount.Load(), item.lastAccess.Load()})
+			}
+		}
+		shard.RUnlock()
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		if c := cmp.Compare(b.count, a.count); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.lastAccess, a.lastAccess)
+	})
+
+	keys := make([]K, 0, min(n, len(entries)))
+	for _, e := range entries[:min(n, len(entries))] {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// snapshot returns a copy of every live item, made by copyValue. Every shard
+// is read locked together, so the result is a consistent view of the cache
+// at a single point in time
+func (cache *Cache[K, V]) snapshot(copyValue func(value V) V) map[K]V {
+	for _, shard := range cache.shards {
+		shard.RLock()
+		defer shard.RUnlock()
+	}
+
+	now := cache.clock.Now().Unix()
+	items := make(map[K]V)
+	for _, shard := range cache.shards {
+		for key, item := range shard.items {
+			if item.live(now) {
+				items[key] = copyValue(item.value)
+			}
+		}
+	}
+	return items
+}
+
+// Range calls fn for each live item, stopping early if fn returns false. The
+// items are snapshotted first and fn is called without any lock held, so it
+// may safely use the cache but won't see changes made during the walk
+func (cache *Cache[K, V]) Range(fn func(key K, value V) bool) {
+	type entry struct {
+		key   K
+		value V
+	}
+
+	now := cache.clock.Now().Unix()
+	var snapshot []entry
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for key, item := range shard.items {
+			if item.live(now) {
+				snapshot = append(snapshot, entry{key, item.value})
+			}
+		}
+		shard.RUnlock()
+	}
+
+	for _, e := range snapshot {
+		if !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+// Delete removes a single item from the cache ahead of its expiry, returning
+// ErrNotFound if there was nothing stored under the given key
+func (cache *Cache[K, V]) Delete(key K) error {
+	shard := cache.shardFor(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+
+	item, exists := shard.items[key]
+	if !exists {
+		return ErrNotFound
+	}
+	shard.remove(key)
+	cache.removed(EventDelete, item)
+
+	return nil
+}
+
+// deleteWhere removes every live item for which pred returns true, returning
+// how many were removed
+func (cache *Cache[K, V]) deleteWhere(pred func(key K, value V) bool) int {
+	now := cache.clock.Now().Unix()
+	removed := 0
+	for _, shard := range cache.shards {
+		removed += cache.deleteWhereInShard(shard, pred, now)
+	}
+	return removed
+}
+
+// deleteWhereInShard removes the shard's live items for which pred returns
+// true, returning how many were removed
+func (cache *Cache[K, V]) deleteWhereInShard(shard *cacheShard[K, V], pred func(key K, value V) bool, now int64) int {
+	shard.Lock()
+	defer shard.Unlock()
+
+	removed := 0
+	for key, item := range shard.items {
+		if item.live(now) && pred(key, item.value) {
+			shard.remove(key)
+			cache.removed(EventDelete, item)
+			removed++
+		}
+	}
+	return removed
+}
+
+// evictForSpace removes an item, chosen by the eviction policy, from the shard
+// if it is at its share of the configured capacity. The caller must hold the
+// shard's write lock
+func (cache *Cache[K, V]) evictForSpace(shard *cacheShard[K, V]) {
+	shardMax, bounded := cache.shardMaxItems()
+	if !bounded || len(shard.items) < shardMax {
+		return
+	}
+
+	cache.evict(shard, cache.victim(shard))
+}
+
+// shardMaxItems returns each shard's share of the item cap, reporting false
+// if the cache is unbounded
+func (cache *Cache[K, V]) shardMaxItems() (int, bool) {
+	maxItems := int(cache.maxItems.Load())
+	if maxItems <= 0 {
+		return 0, false
+	}
+	// split the cap evenly, rounding up so the shards hold at least maxItems
+	return (maxItems + len(cache.shards) - 1) / len(cache.shards), true
+}
+
+// Resize changes the item cap set by WithMaxItems, immediately evicting items
+// chosen by the eviction policy from any shard now holding more than its
+// share of the new cap, as described by WithShards. A cap of zero or less
+// makes the cache unbounded
+func (cache *Cache[K, V]) Resize(newMax int) {
+	cache.maxItems.Store(int64(newMax))
+
+	shardMax, bounded := cache.shardMaxItems()
+	if !bounded {
+		return
+	}
+	for _, shard := range cache.shards {
+		cache.shrinkShard(shard, shardMax)
+	}
+}
+
+// shrinkShard evicts items chosen by the eviction policy until the shard holds
+// no more than shardMax
+func (cache *Cache[K, V]) shrinkShard(shard *cacheShard[K, V], shardMax int) {
+	shard.Lock()
+	defer shard.Unlock()
+
+	for len(shard.items) > shardMax {
+		cache.evict(shard, cache.victim(shard))
+	}
+}
+
+// victim returns the key of the item the eviction policy would evict next.
+// The caller must hold the shard's write lock
+func (cache *Cache[K, V]) victim(shard *cacheShard[K, V]) K {
+	if cache.config.evictionPolicy == PolicyLFU {
+		return shard.leastFrequentlyUsed()
+	}
+	return shard.leastRecentlyUsed()
+}
+
+// evictForBytes removes items from the shard, soonest to expire first, until
+// an item of the given size fits within its share of the configured byte
+// limit. Permanent items are only evicted, as chosen by the eviction policy,
+// once nothing else is left. The caller must hold the shard's write lock
+func (cache *Cache[K, V]) evictForBytes(shard *cacheShard[K, V], size int) {
+	if cache.config.maxBytes <= 0 {
+		return
+	}
+	shardMax := (cache.config.maxBytes + len(cache.shards) - 1) / len(cache.shards)
+
+	for shard.bytes+size > shardMax && len(shard.items) > 0 {
+		if shard.expirations.Len() > 0 {
+			cache.evict(shard, shard.expirations[0].itemKey)
+		} else {
+			cache.evict(shard, cache.victim(shard))
+		}
+	}
+}
+
+// evict removes an item to make room for another. The caller must hold the
+// shard's write lock
+func (cache *Cache[K, V]) evict(shard *cacheShard[K, V], key K) {
+	item, exists := shard.items[key]
+	shard.remove(key)
+	cache.counters.evictions.Add(1)
+	cache.logger.Printf("evicted item %v\n", key)
+	if exists {
+		cache.removed(EventEvict, item)
+	}
+}
+
+// SizeBytes returns the total estimated size of the cached items, as measured
+// by the sizer set with WithSizer
+func (cache *Cache[K, V]) SizeBytes() int {
+	total := 0
+	for _, shard := range cache.shards {
+		shard.RLock()
+		total += shard.bytes
+		shard.RUnlock()
+	}
+	return total
+}
+
+// scheduleExpiry moves key's heap entry to match the given expiry, waking the
+// cleanup routine in case it is now the soonest to expire. The caller must
+// hold the shard's write lock
+func (cache *Cache[K, V]) scheduleExpiry(shard *cacheShard[K, V], key K, expiry int64) {
+	// the cleanup routine sleeps until the soonest expiry, so let it know
+	// when that may have changed
+	if shard.scheduleExpiry(key, expiry) {
+		cache.wakeCleanup()
+	}
+}
+
+// Shutdown stops the cleanup routine and drops all items, after which reads
+// and writes return ErrClosed. It is safe to call more than once, with any
+// calls after the first only waiting for queued write-behind values
+func (cache *Cache[K, V]) Shutdown() {
+	if !cache.closed.Swap(true) {
+		cache.logger.Printf("shutting down cache...")
+		cache.dropAll()
+		cache.cancel()
+		cache.watchers.closeAll()
+	}
+
+	// wait for any queued write-behind values to reach the writer, which
+	// also applies when the cache was closed by cancelling its context
+	if cache.behind != nil {
+		<-cache.behind.flushed
+	}
+}
+
+// clone creates a new cache with the same configuration, running until ctx is
+// cancelled, holding a copy of every live item made by copyValue. Items keep
+// their original expiry, so the clone expires them at the same time
+func (cache *Cache[K, V]) clone(ctx context.Context, copyValue func(value V) V) *Cache[K, V] {
+	clone := newCache[K, V](ctx, cache.config)
+
+	now := cache.clock.Now().Unix()
+	for i, shard := range cache.shards {
+		// both caches have the same number of shards, so keys map to the
+		// same shard index in each
+		clone.copyShard(clone.shards[i], shard, now, copyValue)
+	}
+
+	return clone
+}
+
+// copyShard stores copies of every live item in source into target, a shard
+// of the cache
+func (cache *Cache[K, V]) copyShard(target, source *cacheShard[K, V], now int64, copyValue func(value V) V) {
+	source.RLock()
+	defer source.RUnlock()
+	target.Lock()
+	defer target.Unlock()
+
+	for key, item := range source.items {
+		if item.live(now) {
+			cache.store(target, key, copyValue(item.value), item.cachedAt, item.expiresAt, item.lifespan)
+			target.items[key].priority = item.priority
+		}
+	}
+}
+
+// ShutdownContext is Shutdown, but also waits for the cleanup routine to exit
+// so that nothing is left running once it returns. If ctx is done first it
+// returns ctx.Err(), with the shutdown carrying on in the background
+func (cache *Cache[K, V]) ShutdownContext(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		// Shutdown itself waits on any write-behind flush, which may be slow
+		cache.Shutdown()
+		<-cache.cleanupDone
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel which is closed once the cleanup routine has exited,
+// after Shutdown or the cancellation of the cache's context
+func (cache *Cache[K, V]) Done() <-chan struct{} {
+	return cache.cleanupDone
+}
+
+// Clear removes every item while leaving the cache running and usable
+func (cache *Cache[K, V]) Clear() {
+	cache.dropAll()
+}
+
+// dropAll empties every shard in turn
+func (cache *Cache[K, V]) dropAll() {
+	for _, shard := range cache.shards {
+		shard.drain()
+	}
+}
+
+// startCleanup sleeps until the soonest expiry in the heap rather than polling,
+// falling back to the cleanup interval while the cache is empty. It expires
+// everything left in the cache when its context is cancelled
+func (cache *Cache[K, V]) startCleanup() {
+	defer close(cache.cleanupDone)
+	defer cache.cleanupRunning.Store(false)
+
+	timer := time.NewTimer(cache.untilNextExpiry())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			cache.recovering(cache.clean)
+			timer.Reset(cache.untilNextExpiry())
+		case <-cache.reset:
+			timer.Reset(cache.untilNextExpiry())
+		case <-cache.ctx.Done():
+			// the cache is closed as after Shutdown, so that later calls
+			// return ErrClosed rather than using a cache nothing cleans up.
+			// After Shutdown this finds nothing left, as the items are
+			// already dropped
+			cache.closed.Store(true)
+			cache.recovering(cache.expireAll)
+			cache.watchers.closeAll()
+			cache.logger.Printf("cache cleanup stopped")
+			return
+		}
+	}
+}
+
+// recovering runs fn for the cleanup routine, logging rather than propagating
+// any panic, such as from an OnExpire callback, so that one bad pass doesn't
+// stop items expiring for good
+func (cache *Cache[K, V]) recovering(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			cache.logger.Printf("recovered from panic during cache cleanup: %v", r)
+		}
+	}()
+	fn()
+}
+
+// expireAll removes every item as though it had expired, running the
+// OnExpire callback for each
+func (cache *Cache[K, V]) expireAll() {
+	var expired []*cachedItem[K, V]
+	for _, shard := range cache.shards {
+		expired = append(expired, shard.drain()...)
+	}
+
+	for _, item := range expired {
+		cache.counters.expirations.Add(1)
+		cache.removed(EventExpire, item)
+	}
+	cache.runOnExpire(expired)
+}
+
+// wakeCleanup signals the cleanup routine without blocking, a pending signal
+// already covers any new ones
+func (cache *Cache[K, V]) wakeCleanup() {
+	select {
+	case cache.reset <- struct{}{}:
+	default:
+	}
+}
+
+// NextExpiry returns when the soonest expiring item is due to expire, by
+// peeking at the top of each shard's heap. It returns false when nothing in
+// the cache is due to expire
+func (cache *Cache[K, V]) NextExpiry() (time.Time, bool) {
+	soonest, found := int64(0), false
+	for _, shard := range cache.shards {
+		if expiry, ok := shard.nextExpiry(); ok && (!found || expiry < soonest) {
+			soonest, found = expiry, true
+		}
+	}
+	if !found {
+		return time.Time{}, false
+	}
+	return time.Unix(soonest, 0), true
+}
+
+// ExpiringSoon returns the keys of up to n live items, soonest to expire
+// first. The heaps are copied rather than popped, so the cache is left as is.
+// Permanent items never expire, so are never included
+func (cache *Cache[K, V]) ExpiringSoon(n int) []K {
+	if n <= 0 {
+		return nil
+	}
+
+	// copy the entries themselves, as popping moves their indexes
+	now := cache.clock.Now().Unix()
+	var soonest expirationQueue[K]
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for _, entry := range shard.expirations {
+			if item, exists := shard.items[entry.itemKey]; exists && item.live(now) {
+				soonest = append(soonest, &itemExpiry[K]{
+					itemKey:        entry.itemKey,
+					unixExpiryTime: entry.unixExpiryTime,
+					index:          len(soonest),
+				})
+			}
+		}
+		shard.RUnlock()
+	}
+	heap.Init(&soonest)
+
+	keys := make([]K, 0, min(n, soonest.Len()))
+	for soonest.Len() > 0 && len(keys) < n {
+		keys = append(keys, heap.Pop(&soonest).(*itemExpiry[K]).itemKey)
+	}
+	return keys
+}
+
+func (cache *Cache[K, V]) untilNextExpiry() time.Duration {
+	soonest, found := cache.NextExpiry()
+	if !found {
+		return cache.config.cleanupInterval
+	}
+
+	// items are kept past their expiry for the stale window
+	wait := soonest.Add(cache.config.staleWindow).Sub(cache.clock.Now())
+	if wait < 0 {
+		return 0
+	}
+
+	// wake early to refresh the soonest item ahead of its expiry. Once it is
+	// within the window there's no point waking again before it expires, as
+	// its refresh has already been started
+	if cache.refresher != nil {
+		if ahead := soonest.Add(-cache.config.refreshAhead).Sub(cache.clock.Now()); ahead > 0 {
+			return min(wait, ahead)
+		}
+	}
+	return wait
+}
+
+// Purge runs a cleanup pass immediately, rather than waiting for the cleanup
+// routine, removing every item which has expired by the cache's clock
+func (cache *Cache[K, V]) Purge() {
+	cache.clean()
+}
+
+func (cache *Cache[K, V]) clean() {
+	expired := cache.removeExpired()
+	cache.refreshAheadOfExpiry()
+	cache.runOnExpire(expired)
+	cache.lastCleanup.Store(&cleanupRecord{at: cache.clock.Now(), removed: len(expired)})
+}
+
+// guardExpired asks the expiry guard, if there is one, whether each popped item
+// should be kept, putting those it keeps back with their new expiry. It
+// returns the items which really have expired. The caller must hold the
+// shard's write lock
+func (cache *Cache[K, V]) guardExpired(shard *cacheShard[K, V], popped []*cachedItem[K, V], now time.Time) []*cachedItem[K, V] {
+	if cache.expiryGuard == nil {
+		return popped
+	}
+
+	expired := popped[:0]
+	for _, item := range popped {
+		if item.missing { // negative entries have no value to judge
+			expired = append(expired, item)
+			continue
+		}
+		keep, extend := cache.askGuard(item)
+		if !keep {
+			expired = append(expired, item)
+			continue
+		}
+
+		if extend > 0 {
+			// expiries are tracked to the second, so anything shorter would
+			// leave the item due to expire again straight away
+			extend = max(extend, time.Second)
+		}
+		item.expiresAt = expiryFor(now.Unix(), extend)
+		item.lifespan = max(extend, 0)
+		shard.items[item.key] = item
+		shard.bytes += item.size
+		cache.scheduleExpiry(shard, item.key, item.expiresAt)
+	}
+	return expired
+}
+
+// askGuard runs the expiry guard on item, treating a panic as not keeping it
+// so that a faulty guard can't leave the shard locked or lose popped items
+func (cache *Cache[K, V]) askGuard(item *cachedItem[K, V]) (keep bool, extend time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			cache.logger.Printf("recovered from panic in expiry guard for item %v: %v", item.key, r)
+			keep, extend = false, 0
+		}
+	}()
+	return cache.expiryGuard(item.key, item.value)
+}
+
+// expireItem removes an expired item found outside the cleanup pass, unless
+// the expiry guard keeps it, reporting whether it was removed. The caller must
+// hold the shard's write lock, and pass a removed item to runOnExpire once it
+// has let go of it
+func (cache *Cache[K, V]) expireItem(shard *cacheShard[K, V], item *cachedItem[K, V], now time.Time) bool {
+	shard.remove(item.key)
+	if len(cache.guardExpired(shard, []*cachedItem[K, V]{item}, now)) == 0 {
+		return false
+	}
+	cache.counters.expirations.Add(1)
+	cache.removed(EventExpire, item)
+	return true
+}
+
+// runOnExpire calls the OnExpire callback for each expired item. Callbacks run
+// outside the lock so that they are free to use the cache
+func (cache *Cache[K, V]) runOnExpire(expired []*cachedItem[K, V]) {
+	if cache.onExpire == nil {
+		return
+	}
+	for _, item := range expired {
+		if !item.missing { // negative entries have no value to report
+			cache.callOnExpire(item)
+		}
+	}
+}
+
+// callOnExpire runs the OnExpire callback for item, logging rather than
+// propagating a panic so that the callbacks for the remaining items still run
+func (cache *Cache[K, V]) callOnExpire(item *cachedItem[K, V]) {
+	defer func() {
+		if r := recover(); r != nil {
+			cache.logger.Printf("recovered from panic in OnExpire for item %v: %v", item.key, r)
+		}
+	}()
+	cache.onExpire(item.key, item.value)
+}
+
+// expired reports whether the item's expiry has passed, permanent items never expire
+func (item *cachedItem[K, V]) expired(now int64) bool {
+	return item.expiresAt != neverExpires && item.expiresAt <= now
+}
+
+// live reports whether the item holds a value which hasn't expired
+func (item *cachedItem[K, V]) live(now int64) bool {
+	return !item.missing && !item.expired(now)
+}
+
+func (item *cachedItem[K, V]) touch(at time.Time) {
+	item.lastAccess.Store(at.UnixNano())
+}
+
+// hit records a successful read of the item
+func (item *cachedItem[K, V]) hit(at time.Time) {
+	item.touch(at)
+	item.accessCount.Add(1)
+}
+
+// removeExpired pops every expired item off each shard's heap, returning what
+// was removed
+func (cache *Cache[K, V]) removeExpired() []*cachedItem[K, V] {
+	now := cache.clock.Now()
+	cache.logger.Printf("cleaning for expiries older than %s", now.Format("02/01/2006 15:04:05"))
+
+	var expired []*cachedItem[K, V]
+	for _, shard := range cache.shards {
+		popped := cache.expireShard(shard, now)
+		for _, item := range popped {
+			cache.counters.expirations.Add(1)
+			cache.logger.Printf("deleted item %v\n", item.key)
+			cache.removed(EventExpire, item)
+		}
+		expired = append(expired, popped...)
+	}
+	cache.logger.Printf("cache cleanup completed")
+	return expired
+}
+
+// expireShard pops the shard's expired items, less any kept by the expiry
+// guard, returning what was removed
+func (cache *Cache[K, V]) expireShard(shard *cacheShard[K, V], now time.Time) []*cachedItem[K, V] {
+	shard.Lock()
+	defer shard.Unlock()
+
+	popped := shard.popExpired(cache.staleCutoff(now.Unix()))
+	return cache.guardExpired(shard, popped, now)
+}
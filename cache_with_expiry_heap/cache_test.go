@@ -0,0 +1,1093 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLenCountsOnlyLiveItems(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	for i, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id), time.Duration(i+1)*10*time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+
+	for _, step := range []struct {
+		advance time.Duration
+		want    int
+	}{
+		{0, 3},
+		{10 * time.Second, 2},
+		{10 * time.Second, 1},
+		{10 * time.Second, 0},
+	} {
+		clock.Advance(step.advance)
+		if got := cache.Len(); got != step.want {
+			t.Fatalf("Len at %s: got %d, want %d", clock.Now().Format(time.TimeOnly), got, step.want)
+		}
+	}
+}
+
+func TestGetSlidingKeepsHotItemsAlive(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), 10*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// each read slides the expiry on by the lifespan, carrying the item well
+	// past its original expiry
+	for i := 0; i < 5; i++ {
+		clock.Advance(8 * time.Second)
+		if _, err := cache.GetSliding("a"); err != nil {
+			t.Fatalf("GetSliding after %d reads: %v", i, err)
+		}
+	}
+
+	clock.Advance(10 * time.Second)
+	if _, err := cache.Get("a"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get once reads stop: got %v, want ErrExpired", err)
+	}
+}
+
+func TestGetOrSetLoadsOnceForConcurrentMisses(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func() (*MyState, error) {
+		calls.Add(1)
+		<-release
+		return newState("a", 1), nil
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if state, err := cache.GetOrSet("a", time.Minute, loader); err != nil || state.Id != "a" {
+				t.Errorf("GetOrSet: got %v, %v", state, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let every caller miss
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("loader called %d times, want once", got)
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get after GetOrSet: %v", err)
+	}
+}
+
+func TestGetOrSetDoesNotCacheErrors(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	errLoad := errors.New("backend down")
+	if _, err := cache.GetOrSet("a", time.Minute, func() (*MyState, error) { return nil, errLoad }); !errors.Is(err, errLoad) {
+		t.Fatalf("failing loader: got %v, want its error", err)
+	}
+	state, err := cache.GetOrSet("a", time.Minute, func() (*MyState, error) { return newState("a"), nil })
+	if err != nil || state.Id != "a" {
+		t.Fatalf("after the failure: got %v, %v, want the loader called again", state, err)
+	}
+}
+
+func TestShutdownRacesWithSet(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := cache.Set(newState(fmt.Sprintf("state#%d-%d", i, j)), time.Minute)
+				if err != nil && !errors.Is(err, ErrClosed) {
+					t.Errorf("Set: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	cache.Shutdown()
+	cache.Shutdown() // a second call must not panic
+	wg.Wait()
+
+	if err := cache.Set(newState("late"), time.Minute); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Set after Shutdown: got %v, want ErrClosed", err)
+	}
+}
+
+func TestGetRemovesExpiredItem(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+
+	if _, err := cache.Get("a"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get: got %v, want ErrExpired", err)
+	}
+
+	shard := cache.shardFor("a")
+	shard.RLock()
+	items, tracked, queued := len(shard.items), len(shard.expiryMap), shard.expirations.Len()
+	shard.RUnlock()
+	if items != 0 || tracked != 0 || queued != 0 {
+		t.Fatalf("after Get: %d items, %d expiry entries, %d heap entries, want none", items, tracked, queued)
+	}
+	if _, err := cache.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Get: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestCleanupWakesForNextExpiry(t *testing.T) {
+	cache := NewMyStateCache(context.Background(), WithLogger(NopLogger{}))
+	defer cache.Shutdown()
+
+	start := time.Now()
+	if err := cache.Set(newState("a"), 2*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// the cleanup routine should remove the item itself, well before the
+	// default 20 second interval, without any Get finding it expired
+	shard := cache.shardFor("a")
+	for time.Since(start) < 5*time.Second {
+		shard.RLock()
+		_, exists := shard.items["a"]
+		shard.RUnlock()
+		if !exists {
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Fatalf("item removed after %s, want around 2s", elapsed)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("item was not removed by the cleanup routine")
+}
+
+func TestOnExpireRunsForEachExpiredItem(t *testing.T) {
+	var expired atomic.Int32
+	cache, clock := newTestCache(t, WithOnExpire(func(id string, state *MyState) {
+		expired.Add(1)
+	}))
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id), time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	if err := cache.Set(newState("d"), time.Minute); err != nil {
+		t.Fatalf("Set d: %v", err)
+	}
+
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+
+	if got := expired.Load(); got != 3 {
+		t.Fatalf("OnExpire called %d times, want 3", got)
+	}
+}
+
+func TestOnExpireMayUseTheCache(t *testing.T) {
+	var cache *MyStateCache
+	done := make(chan struct{})
+	cache, clock := newTestCache(t, WithOnExpire(func(id string, state *MyState) {
+		// the callback runs outside the lock, so this mustn't deadlock
+		_ = cache.Set(newState(id+"-final"), time.Minute)
+		close(done)
+	}))
+
+	if err := cache.Set(newState("a"), time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("OnExpire did not complete")
+	}
+	if !cache.Has("a-final") {
+		t.Fatal("item set by OnExpire is missing")
+	}
+}
+
+func TestOnExpireRunsForLazilyExpiredItems(t *testing.T) {
+	var mu sync.Mutex
+	var expired []string
+	cache, clock := newTestCache(t, WithOnExpire(func(id string, _ *MyState) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired = append(expired, id)
+	}))
+
+	for _, id := range []string{"get", "getAndDelete"} {
+		if err := cache.Set(newState(id), time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	if err := cache.Set(newState("expire"), time.Minute); err != nil {
+		t.Fatalf("Set expire: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+
+	// each removes its item before any cleanup pass runs
+	if _, err := cache.Get("get"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get: got %v, want ErrExpired", err)
+	}
+	if _, err := cache.GetAndDelete("getAndDelete"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("GetAndDelete: got %v, want ErrExpired", err)
+	}
+	if err := cache.Expire("expire", clock.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Expire in the past: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"get", "getAndDelete", "expire"}; !slices.Equal(expired, want) {
+		t.Fatalf("OnExpire called for %v, want %v", expired, want)
+	}
+}
+
+func TestPermanentItemsNeverExpire(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("config"), 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, found := cache.NextExpiry(); found {
+		t.Fatal("permanent item was added to the expiration heap")
+	}
+
+	clock.Advance(1000 * time.Hour)
+	cache.Purge()
+
+	if _, err := cache.Get("config"); err != nil {
+		t.Fatalf("Get long after any normal TTL: %v", err)
+	}
+}
+
+func TestClearKeepsCacheUsable(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id), time.Minute); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+
+	cache.Clear()
+	if got := cache.Len(); got != 0 {
+		t.Fatalf("Len after Clear: got %d, want 0", got)
+	}
+
+	if err := cache.Set(newState("d"), time.Minute); err != nil {
+		t.Fatalf("Set after Clear: %v", err)
+	}
+	if _, err := cache.Get("d"); err != nil {
+		t.Fatalf("Get after Clear: %v", err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(nil, time.Minute); !errors.Is(err, ErrNilState) {
+		t.Errorf("Set nil: got %v, want ErrNilState", err)
+	}
+	if _, err := cache.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get missing: got %v, want ErrNotFound", err)
+	}
+
+	if err := cache.Set(newState("a"), time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := cache.Get("a"); !errors.Is(err, ErrExpired) {
+		t.Errorf("Get expired: got %v, want ErrExpired", err)
+	}
+}
+
+func TestGetAndDeleteConsumesOnce(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	for round := 0; round < 50; round++ {
+		if err := cache.Set(newState("token"), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+
+		var consumed atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := cache.GetAndDelete("token")
+				switch {
+				case err == nil:
+					consumed.Add(1)
+				case !errors.Is(err, ErrNotFound):
+					t.Errorf("GetAndDelete: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if got := consumed.Load(); got != 1 {
+			t.Fatalf("round %d: token consumed %d times, want once", round, got)
+		}
+	}
+}
+
+func TestSetManyAndGetMany(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	states := []*MyState{newState("a", 1), newState("b", 2), newState("c", 3)}
+	if err := cache.SetMany(states, 10*time.Second); err != nil {
+		t.Fatalf("SetMany: %v", err)
+	}
+	if err := cache.Set(newState("short"), time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+
+	found := cache.GetMany([]string{"a", "c", "short", "missing"})
+	if len(found) != 2 {
+		t.Fatalf("GetMany: got %d items, want a and c only", len(found))
+	}
+	for _, id := range []string{"a", "c"} {
+		if state := found[id]; state == nil || state.Id != id {
+			t.Errorf("GetMany[%s]: got %v", id, state)
+		}
+	}
+	if ttl, err := cache.TTL("b"); err != nil || ttl != 8*time.Second {
+		t.Errorf("TTL b: got %s, %v, want the shared lifespan less elapsed time, 8s", ttl, err)
+	}
+}
+
+func TestSetManyWithNilStoresNothing(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	err := cache.SetMany([]*MyState{newState("a"), nil, newState("b")}, time.Minute)
+	if !errors.Is(err, ErrNilState) {
+		t.Fatalf("SetMany: got %v, want ErrNilState", err)
+	}
+	if got := cache.Len(); got != 0 {
+		t.Fatalf("Len: got %d, want 0 as the batch is rejected whole", got)
+	}
+}
+
+func TestTouchExtendsExpiry(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), 10*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(9 * time.Second)
+	if err := cache.Touch("a", 10*time.Second); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+
+	clock.Advance(5 * time.Second)
+	cache.Purge()
+	if !cache.Has("a") {
+		t.Fatal("touched item was cleaned at its original expiry")
+	}
+
+	if err := cache.Touch("missing", time.Second); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Touch missing: got %v, want ErrNotFound", err)
+	}
+	clock.Advance(5 * time.Second)
+	if err := cache.Touch("a", time.Second); !errors.Is(err, ErrExpired) {
+		t.Errorf("Touch expired: got %v, want ErrExpired", err)
+	}
+}
+
+func TestSubSecondTouchLastsASecond(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := cache.Touch("a", 500*time.Millisecond); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get straight after Touch: %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := cache.Get("a"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get a second after Touch: got %v, want ErrExpired", err)
+	}
+}
+
+func TestTouchedPermanentItemSlides(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := cache.Touch("a", 10*time.Second); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+
+	// the extend becomes the lifespan GetSliding renews, rather than the
+	// zero lifespan of a permanent item
+	if _, err := cache.GetSliding("a"); err != nil {
+		t.Fatalf("GetSliding: %v", err)
+	}
+	clock.Advance(5 * time.Second)
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get after sliding: %v", err)
+	}
+}
+
+func TestGetWithMetadataReportsTimes(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	setAt := clock.Now()
+	if err := cache.Set(newState("a"), time.Minute); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+	if err := cache.Set(newState("b"), 0); err != nil {
+		t.Fatalf("Set b: %v", err)
+	}
+	clock.Advance(10 * time.Second)
+
+	_, metadata, err := cache.GetWithMetadata("a")
+	if err != nil {
+		t.Fatalf("GetWithMetadata a: %v", err)
+	}
+	if !metadata.CachedAt.Equal(setAt) || !metadata.ExpiresAt.Equal(setAt.Add(time.Minute)) {
+		t.Errorf("a: got cached %s expiring %s, want cached %s expiring a minute later", metadata.CachedAt, metadata.ExpiresAt, setAt)
+	}
+
+	_, metadata, err = cache.GetWithMetadata("b")
+	if err != nil {
+		t.Fatalf("GetWithMetadata b: %v", err)
+	}
+	if !metadata.ExpiresAt.IsZero() {
+		t.Errorf("permanent b: got ExpiresAt %s, want the zero time", metadata.ExpiresAt)
+	}
+}
+
+func TestPurgeRemovesExpiredItems(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), 5*time.Second); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+	if err := cache.Set(newState("b"), time.Minute); err != nil {
+		t.Fatalf("Set b: %v", err)
+	}
+
+	clock.Advance(6 * time.Second)
+	cache.Purge()
+
+	// ErrNotFound rather than ErrExpired shows the item has been removed,
+	// rather than being left for Get to find expired
+	if _, err := cache.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get a: got %v, want ErrNotFound", err)
+	}
+	if !cache.Has("b") {
+		t.Error("unexpired b was purged")
+	}
+}
+
+func TestOperationsAfterShutdownReturnErrClosed(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.Set(newState("a"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	cache.Shutdown()
+	cache.Shutdown()
+
+	if err := cache.Set(newState("b"), time.Minute); !errors.Is(err, ErrClosed) {
+		t.Errorf("Set: got %v, want ErrClosed", err)
+	}
+	if _, err := cache.Get("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get: got %v, want ErrClosed", err)
+	}
+	if err := cache.Delete("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Delete: got %v, want ErrClosed", err)
+	}
+}
+
+func TestGetContextCancelledMidLoad(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	var loads atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	loader := func(ctx context.Context) (*MyState, error) {
+		if loads.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return newState("a"), ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := cache.GetContext(ctx, "a", time.Minute, loader)
+		cancelled <- err
+	}()
+	<-started
+
+	shared := make(chan error, 1)
+	go func() {
+		_, err := cache.GetContext(context.Background(), "a", time.Minute, loader)
+		shared <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("cancelled caller: got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled caller kept waiting on the load")
+	}
+
+	// the load carries on for the other caller, with a context which
+	// wasn't cancelled along with the first caller's
+	close(release)
+	if err := <-shared; err != nil {
+		t.Fatalf("sharing caller: %v", err)
+	}
+	if got := loads.Load(); got != 1 {
+		t.Errorf("loader called %d times, want once", got)
+	}
+	if !cache.Has("a") {
+		t.Error("loaded value was not cached")
+	}
+}
+
+func TestHas(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("present"), time.Minute); err != nil {
+		t.Fatalf("Set present: %v", err)
+	}
+	if err := cache.Set(newState("expired"), time.Second); err != nil {
+		t.Fatalf("Set expired: %v", err)
+	}
+	clock.Advance(time.Second)
+
+	for id, want := range map[string]bool{"present": true, "absent": false, "expired": false} {
+		if got := cache.Has(id); got != want {
+			t.Errorf("Has(%q): got %t, want %t", id, got, want)
+		}
+	}
+}
+
+func TestRangeSumsLiveValues(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a", 1, 2), time.Minute); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+	if err := cache.Set(newState("b", 3, 4), time.Minute); err != nil {
+		t.Fatalf("Set b: %v", err)
+	}
+	if err := cache.Set(newState("expired", 100), time.Second); err != nil {
+		t.Fatalf("Set expired: %v", err)
+	}
+	clock.Advance(time.Second)
+
+	sum := 0
+	cache.Range(func(id string, state *MyState) bool {
+		for _, v := range state.Values {
+			sum += v
+		}
+		return true
+	})
+	if sum != 10 {
+		t.Fatalf("sum of live values: got %d, want 10", sum)
+	}
+
+	visited := 0
+	cache.Range(func(string, *MyState) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatalf("Range visited %d items after fn returned false, want 1", visited)
+	}
+}
+
+func TestNextExpiryIsTheEarliest(t *testing.T) {
+	cache, clock := newTestCache(t, WithShards(4))
+
+	if _, found := cache.NextExpiry(); found {
+		t.Fatal("NextExpiry of an empty cache: got true")
+	}
+
+	for id, lifespan := range map[string]time.Duration{"a": time.Hour, "b": 5 * time.Second, "c": time.Minute, "d": 0} {
+		if err := cache.Set(newState(id), lifespan); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+
+	next, found := cache.NextExpiry()
+	if want := clock.Now().Add(5 * time.Second); !found || !next.Equal(want) {
+		t.Fatalf("NextExpiry: got %s, %t, want %s", next, found, want)
+	}
+}
+
+func TestExpiryJitterSpreadsExpiries(t *testing.T) {
+	cache, _ := newTestCache(t, WithExpiryJitter(time.Minute))
+
+	expiries := make(map[time.Duration]int)
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("state#%d", i)
+		if err := cache.Set(newState(id), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		ttl, err := cache.TTL(id)
+		if err != nil {
+			t.Fatalf("TTL: %v", err)
+		}
+		if ttl < time.Minute || ttl > 2*time.Minute {
+			t.Fatalf("TTL %s is outside the lifespan plus up to a minute of jitter", ttl)
+		}
+		expiries[ttl]++
+	}
+
+	// 100 draws from 61 possible offsets are all but certain to hit many
+	if len(expiries) < 10 {
+		t.Fatalf("only %d distinct expiries across 100 items, want them spread", len(expiries))
+	}
+}
+
+func TestTopAccessedOrdersByReads(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	for id, reads := range map[string]int{"a": 1, "b": 5, "c": 3, "d": 0} {
+		if err := cache.Set(newState(id), time.Minute); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+		for i := 0; i < reads; i++ {
+			if _, err := cache.Get(id); err != nil {
+				t.Fatalf("Get %s: %v", id, err)
+			}
+		}
+	}
+
+	if got := cache.TopAccessed(3); !slices.Equal(got, []string{"b", "c", "a"}) {
+		t.Fatalf("TopAccessed(3): got %v, want [b c a]", got)
+	}
+}
+
+func TestCleanupSurvivesPanickingCallback(t *testing.T) {
+	var calls atomic.Int32
+	cache, clock := newTestCache(t, WithCleanupInterval(10*time.Millisecond), WithOnExpire(func(string, *MyState) {
+		if calls.Add(1) == 1 {
+			panic("callback failed")
+		}
+	}))
+
+	// both items are left to the cleanup routine, the first panicking in
+	// its callback
+	if err := cache.Set(newState("a"), time.Second); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	eventually(t, 3*time.Second, func() bool { return calls.Load() == 1 })
+
+	if err := cache.Set(newState("b"), time.Second); err != nil {
+		t.Fatalf("Set b: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	eventually(t, 3*time.Second, func() bool { return calls.Load() == 2 })
+
+	if _, err := cache.Get("b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get b: got %v, want ErrNotFound as the cleanup routine removed it", err)
+	}
+}
+
+func TestPanickingCallbackDoesNotSkipOthers(t *testing.T) {
+	var calls atomic.Int32
+	cache, clock := newTestCache(t, WithOnExpire(func(string, *MyState) {
+		if calls.Add(1) == 1 {
+			panic("callback failed")
+		}
+	}))
+
+	// all three expire in the same pass, whichever runs first panicking
+	for _, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id), time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("OnExpire called %d times, want once for each of the 3 items", got)
+	}
+	if removed, at := cache.LastCleanupStats(); removed != 3 || !at.Equal(clock.Now()) {
+		t.Fatalf("LastCleanupStats: got %d at %s, want 3 at %s", removed, at, clock.Now())
+	}
+}
+
+func TestSetRejectsAlreadyExpiredLifespans(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	for _, lifespan := range []time.Duration{-time.Second, time.Millisecond} {
+		if err := cache.Set(newState("a"), lifespan); !errors.Is(err, ErrExpiredLifespan) {
+			t.Errorf("Set for %s: got %v, want ErrExpiredLifespan", lifespan, err)
+		}
+	}
+	if _, err := cache.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get: got %v, want ErrNotFound as nothing was stored", err)
+	}
+	if _, found := cache.NextExpiry(); found {
+		t.Fatal("rejected item was added to the expiration heap")
+	}
+}
+
+func TestGetMultiOrLoadLoadsOnlyMissingIds(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	for _, id := range []string{"a", "c"} {
+		if err := cache.Set(newState(id), time.Minute); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+
+	var asked [][]string
+	loader := func(missing []string) (map[string]*MyState, error) {
+		asked = append(asked, missing)
+		loaded := make(map[string]*MyState, len(missing))
+		for _, id := range missing {
+			loaded[id] = newState(id)
+		}
+		return loaded, nil
+	}
+
+	got, err := cache.GetMultiOrLoad([]string{"a", "b", "c", "d", "b"}, time.Minute, loader)
+	if err != nil {
+		t.Fatalf("GetMultiOrLoad: %v", err)
+	}
+	if len(asked) != 1 || !slices.Equal(asked[0], []string{"b", "d"}) {
+		t.Fatalf("loader called with %v, want once with [b d]", asked)
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if state, ok := got[id]; !ok || state.Id != id {
+			t.Errorf("%s: got %v, want it in the result", id, state)
+		}
+	}
+
+	// the loaded states are now cached, so the loader isn't needed again
+	if _, err := cache.GetMultiOrLoad([]string{"b", "d"}, time.Minute, loader); err != nil {
+		t.Fatalf("second GetMultiOrLoad: %v", err)
+	}
+	if len(asked) != 1 {
+		t.Fatalf("loader called %d times, want once", len(asked))
+	}
+}
+
+func TestSetDefaultUsesDefaultTTL(t *testing.T) {
+	cache, clock := newTestCache(t, WithDefaultTTL(10*time.Second))
+
+	if err := cache.SetDefault(newState("a")); err != nil {
+		t.Fatalf("SetDefault: %v", err)
+	}
+
+	clock.Advance(9 * time.Second)
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get before the default TTL: %v", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := cache.Get("a"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get after the default TTL: got %v, want ErrExpired", err)
+	}
+}
+
+func TestSetDefaultWithoutDefaultTTL(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.SetDefault(newState("a")); !errors.Is(err, ErrNoDefaultTTL) {
+		t.Fatalf("got %v, want ErrNoDefaultTTL", err)
+	}
+	if cache.Has("a") {
+		t.Fatal("state stored without a default TTL")
+	}
+}
+
+func TestSetMissingCachesTheMiss(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.SetMissing("a", 5*time.Second); err != nil {
+		t.Fatalf("SetMissing: %v", err)
+	}
+	if _, err := cache.Get("a"); !errors.Is(err, ErrCachedMissing) {
+		t.Fatalf("Get within the TTL: got %v, want ErrCachedMissing", err)
+	}
+	if _, err := cache.Get("b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of an unknown id: got %v, want ErrNotFound", err)
+	}
+
+	// once expired the negative entry is cleaned up like any other
+	clock.Advance(5 * time.Second)
+	cache.Purge()
+	if _, err := cache.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after the TTL: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestExpireAtAbsoluteTime(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), time.Hour); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := cache.Expire("a", clock.Now().Add(2*time.Second)); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+
+	clock.Advance(time.Second)
+	cache.Purge()
+	if !cache.Has("a") {
+		t.Fatal("removed a second before its new expiry")
+	}
+
+	clock.Advance(time.Second)
+	cache.Purge()
+	if _, err := cache.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get at the new expiry: got %v, want ErrNotFound as cleanup removed it", err)
+	}
+}
+
+func TestExpireInThePastRemovesStraightAway(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), time.Hour); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := cache.Expire("a", clock.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	if _, err := cache.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestPeekIsNotCounted(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.Set(newState("a"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if state, ok := cache.Peek("a"); !ok || state.Id != "a" {
+		t.Fatalf("Peek: got %v, %t, want a, true", state, ok)
+	}
+	if _, ok := cache.Peek("missing"); ok {
+		t.Fatal("Peek missing: got true")
+	}
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Fatalf("after Peek: got %d hits and %d misses, want none", stats.Hits, stats.Misses)
+	}
+
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if hits := cache.Stats().Hits; hits != 1 {
+		t.Fatalf("after Get: got %d hits, want 1", hits)
+	}
+}
+
+func TestShutdownContextWaitsForCleanup(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.ShutdownContext(context.Background()); err != nil {
+		t.Fatalf("ShutdownContext: %v", err)
+	}
+
+	// the cleanup routine must already have exited, not merely been told to
+	select {
+	case <-cache.Done():
+	default:
+		t.Fatal("ShutdownContext returned before the cleanup routine exited")
+	}
+}
+
+func TestDoneClosedAfterShutdown(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	select {
+	case <-cache.Done():
+		t.Fatal("Done closed while the cache is running")
+	default:
+	}
+
+	cache.Shutdown()
+	select {
+	case <-cache.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed within a second of Shutdown")
+	}
+}
+
+func TestCancellingContextEmptiesCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var expired []string
+	cache := NewMyStateCache(ctx, WithLogger(NopLogger{}), WithOnExpire(func(id string, _ *MyState) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired = append(expired, id)
+	}))
+	t.Cleanup(cache.Shutdown)
+
+	for _, id := range []string{"a", "b"} {
+		if err := cache.Set(newState(id), time.Hour); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	if err := cache.Set(newState("permanent"), 0); err != nil {
+		t.Fatalf("Set permanent: %v", err)
+	}
+
+	cancel()
+	select {
+	case <-cache.Done():
+	case <-time.After(time.Second):
+		t.Fatal("cleanup routine still running a second after cancelling")
+	}
+
+	mu.Lock()
+	slices.Sort(expired)
+	if want := []string{"a", "b", "permanent"}; !slices.Equal(expired, want) {
+		t.Errorf("OnExpire called for %v, want %v", expired, want)
+	}
+	mu.Unlock()
+	if got := cache.Len(); got != 0 {
+		t.Errorf("Len: got %d, want 0", got)
+	}
+	if _, err := cache.Get("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get: got %v, want ErrClosed", err)
+	}
+}
+
+func TestExpiringSoonOrder(t *testing.T) {
+	cache, _ := newTestCache(t, WithShards(4))
+
+	lifespans := map[string]time.Duration{"c": 30 * time.Second, "a": 10 * time.Second, "d": 40 * time.Second, "b": 20 * time.Second}
+	for id, lifespan := range lifespans {
+		if err := cache.Set(newState(id), lifespan); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	if err := cache.Set(newState("permanent"), 0); err != nil {
+		t.Fatalf("Set permanent: %v", err)
+	}
+
+	if got := cache.ExpiringSoon(3); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("got %v, want [a b c]", got)
+	}
+	// asking again gives the same answer, as the heaps are left alone
+	if got := cache.ExpiringSoon(10); !slices.Equal(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("got %v, want [a b c d] without the permanent item", got)
+	}
+}
+
+func TestExpiryGuardKeepsEveryOtherItemOnce(t *testing.T) {
+	var mu sync.Mutex
+	kept := make(map[string]bool)
+	cache, clock := newTestCache(t, WithExpiryGuard(func(id string, state *MyState) (bool, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if state.Values[0]%2 == 0 || kept[id] {
+			return false, 0
+		}
+		kept[id] = true
+		return true, 5 * time.Second
+	}))
+
+	for i := range 6 {
+		if err := cache.Set(newState(fmt.Sprintf("s%d", i), i), 5*time.Second); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	clock.Advance(5 * time.Second)
+	cache.Purge()
+	if keys := slices.Sorted(slices.Values(cache.Keys())); !slices.Equal(keys, []string{"s1", "s3", "s5"}) {
+		t.Fatalf("after the first expiry: got %v, want [s1 s3 s5] kept", keys)
+	}
+
+	// the guard only keeps each item once, so they all go on the next expiry
+	clock.Advance(5 * time.Second)
+	cache.Purge()
+	if got := cache.Len(); got != 0 {
+		t.Fatalf("after the second expiry: got %d items, want 0", got)
+	}
+}
+
+func TestExpiryGuardConsultedByGet(t *testing.T) {
+	cache, clock := newTestCache(t, WithExpiryGuard(func(string, *MyState) (bool, time.Duration) {
+		return true, time.Minute
+	}))
+
+	if err := cache.Set(newState("a"), 5*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(5 * time.Second)
+
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get: got %v, want the guard to keep the item", err)
+	}
+	if ttl, err := cache.TTL("a"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL: got %s, %v, want the minute the guard extended it by", ttl, err)
+	}
+}
+
+func TestPanickingExpiryGuard(t *testing.T) {
+	cache, clock := newTestCache(t, WithExpiryGuard(func(string, *MyState) (bool, time.Duration) {
+		panic("guard failed")
+	}))
+
+	for _, id := range []string{"a", "b"} {
+		if err := cache.Set(newState(id), 5*time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	clock.Advance(5 * time.Second)
+
+	// a panic counts as not keeping the item, and leaves the shard unlocked
+	if _, err := cache.Get("a"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get: got %v, want ErrExpired", err)
+	}
+	cache.Purge()
+	if got := cache.Len(); got != 0 {
+		t.Fatalf("Len: got %d, want 0", got)
+	}
+	if err := cache.Set(newState("c"), time.Minute); err != nil {
+		t.Fatalf("Set after the panics: %v", err)
+	}
+}
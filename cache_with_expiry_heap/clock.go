@@ -0,0 +1,16 @@
+package main
+
+import "time"
+
+// Clock is the source of the current time for a Cache, letting expiry be
+// driven by something other than the wall clock
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default Clock, backed by time.Now
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock which only moves when advanced, so that expiry can be
+// tested instantly and deterministically
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestCache returns a silent state cache driven by a fake clock, which is
+// shut down when the test ends
+func newTestCache(t *testing.T, opts ...Option) (*MyStateCache, *fakeClock) {
+	t.Helper()
+
+	clock := newFakeClock()
+	opts = append([]Option{WithClock(clock), WithLogger(NopLogger{})}, opts...)
+	cache := NewMyStateCache(context.Background(), opts...)
+	t.Cleanup(cache.Shutdown)
+	return cache, clock
+}
+
+// newState returns a state with the given id and values
+func newState(id string, values ...int) *MyState {
+	return &MyState{Id: id, Values: values}
+}
+
+func TestFakeClockDrivesExpiry(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), 5*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	clock.Advance(4 * time.Second)
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get before expiry: %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := cache.Get("a"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get after expiry: got %v, want ErrExpired", err)
+	}
+}
+
+// eventually polls cond until it holds, failing the test if it doesn't
+// within d
+func eventually(t *testing.T, d time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %s", d)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
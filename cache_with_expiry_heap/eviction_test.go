@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fill sets each id in turn, advancing the clock between them so that their
+// access times differ
+func fill(t *testing.T, cache *MyStateCache, clock *fakeClock, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		clock.Advance(time.Second)
+		if err := cache.Set(newState(id), time.Hour); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+}
+
+// assertKeys fails the test unless exactly the wanted ids are cached
+func assertKeys(t *testing.T, cache *MyStateCache, want ...string) {
+	t.Helper()
+	if got := cache.Len(); got != len(want) {
+		t.Errorf("Len: got %d, want %d", got, len(want))
+	}
+	for _, id := range want {
+		if !cache.Has(id) {
+			t.Errorf("%s was evicted", id)
+		}
+	}
+}
+
+func TestMaxItemsEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, clock := newTestCache(t, WithMaxItems(3))
+	fill(t, cache, clock, "a", "b", "c")
+
+	clock.Advance(time.Second)
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get a: %v", err)
+	}
+	fill(t, cache, clock, "d")
+
+	assertKeys(t, cache, "a", "c", "d")
+}
+
+func TestMaxBytesEvictsSoonestToExpire(t *testing.T) {
+	cache, _ := newTestCache(t,
+		WithSizer(func(state *MyState) int { return len(state.Values) * 8 }),
+		WithMaxBytes(64),
+	)
+
+	for i, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id, 1, 2, 3), time.Duration(i+1)*10*time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+
+	// three states of 24 bytes go over the 64 byte limit, so the one
+	// soonest to expire goes
+	assertKeys(t, cache, "b", "c")
+	if got := cache.SizeBytes(); got != 48 {
+		t.Fatalf("SizeBytes: got %d, want 48", got)
+	}
+}
+
+func TestLFUEvictsLeastFrequentlyUsed(t *testing.T) {
+	cache, clock := newTestCache(t, WithMaxItems(3), WithEvictionPolicy(PolicyLFU))
+	fill(t, cache, clock, "a", "b", "c")
+
+	// a is the oldest item but the most read, while c is the least read
+	for id, reads := range map[string]int{"a": 3, "b": 2, "c": 1} {
+		for i := 0; i < reads; i++ {
+			if _, err := cache.Get(id); err != nil {
+				t.Fatalf("Get %s: %v", id, err)
+			}
+		}
+	}
+	fill(t, cache, clock, "d")
+
+	assertKeys(t, cache, "a", "b", "d")
+}
+
+func TestResizeEvictsDownToNewCap(t *testing.T) {
+	cache, clock := newTestCache(t, WithMaxItems(10))
+	fill(t, cache, clock, "0", "1", "2", "3", "4", "5", "6", "7", "8", "9")
+
+	cache.Resize(5)
+
+	// the least recently used go first
+	assertKeys(t, cache, "5", "6", "7", "8", "9")
+
+	fill(t, cache, clock, "10")
+	assertKeys(t, cache, "6", "7", "8", "9", "10")
+}
+
+func TestEvictionKeepsHighPriorityItems(t *testing.T) {
+	cache, clock := newTestCache(t, WithMaxItems(4))
+
+	// the high priority items are the least recently used, so would be the
+	// first to go on recency alone
+	for _, id := range []string{"high1", "high2"} {
+		clock.Advance(time.Second)
+		if err := cache.SetWithPriority(newState(id), time.Hour, 10); err != nil {
+			t.Fatalf("SetWithPriority %s: %v", id, err)
+		}
+	}
+	fill(t, cache, clock, "low1", "low2", "low3", "low4")
+
+	assertKeys(t, cache, "high1", "high2", "low3", "low4")
+}
+
+func TestSetWithPriorityRejectsNilState(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.SetWithPriority(nil, time.Hour, 10); !errors.Is(err, ErrNilState) {
+		t.Fatalf("SetWithPriority nil: got %v, want ErrNilState", err)
+	}
+}
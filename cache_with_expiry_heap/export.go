@@ -0,0 +1,49 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"slices"
+	"time"
+)
+
+// ExportCSV writes every live state to w as CSV, one row per state sorted by
+// Id, with columns id, cachedAt, expiresAt and values. Times are RFC3339, with
+// expiresAt left empty for permanent states, and values is a JSON array. The
+// states are read from a consistent snapshot of the cache
+func (cache *MyStateCache) ExportCSV(w io.Writer) error {
+	entries := cache.entries()
+	slices.SortFunc(entries, func(a, b snapshotEntry[string, *MyState]) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"id", "cachedAt", "expiresAt", "values"}); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		values, err := json.Marshal(entry.Value.Values)
+		if err != nil {
+			return err
+		}
+
+		expiresAt := ""
+		if entry.ExpiresAt != neverExpires {
+			expiresAt = time.Unix(entry.ExpiresAt, 0).Format(time.RFC3339)
+		}
+		row := []string{
+			entry.Key,
+			time.Unix(entry.CachedAt, 0).Format(time.RFC3339),
+			expiresAt,
+			string(values),
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExportCSVParsesBack(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("b", 3), time.Minute); err != nil {
+		t.Fatalf("Set b: %v", err)
+	}
+	if err := cache.Set(newState("a", 1, 2), 0); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cache.ExportCSV(&buf); err != nil {
+		t.Fatalf("ExportCSV: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the CSV back: %v", err)
+	}
+
+	if len(rows) != 3 || !slices.Equal(rows[0], []string{"id", "cachedAt", "expiresAt", "values"}) {
+		t.Fatalf("got %v, want a header and a row per state", rows)
+	}
+	for _, tc := range []struct {
+		row       []string
+		id        string
+		expiresAt time.Time
+		values    []int
+	}{
+		{rows[1], "a", time.Time{}, []int{1, 2}},
+		{rows[2], "b", clock.Now().Add(time.Minute), []int{3}},
+	} {
+		if tc.row[0] != tc.id {
+			t.Errorf("id: got %q, want %q", tc.row[0], tc.id)
+		}
+		if cachedAt, err := time.Parse(time.RFC3339, tc.row[1]); err != nil || !cachedAt.Equal(clock.Now()) {
+			t.Errorf("%s cachedAt: got %q, want %s", tc.id, tc.row[1], clock.Now())
+		}
+		if tc.expiresAt.IsZero() {
+			if tc.row[2] != "" {
+				t.Errorf("%s expiresAt: got %q, want empty as it is permanent", tc.id, tc.row[2])
+			}
+		} else if expiresAt, err := time.Parse(time.RFC3339, tc.row[2]); err != nil || !expiresAt.Equal(tc.expiresAt) {
+			t.Errorf("%s expiresAt: got %q, want %s", tc.id, tc.row[2], tc.expiresAt)
+		}
+		var values []int
+		if err := json.Unmarshal([]byte(tc.row[3]), &values); err != nil || !slices.Equal(values, tc.values) {
+			t.Errorf("%s values: got %q, want %v", tc.id, tc.row[3], tc.values)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// HealthStatus reports whether the cache is still maintaining itself, for use
+// in liveness probes
+type HealthStatus struct {
+	Running     bool      // the cleanup routine is alive and the cache is open
+	LastCleanup time.Time // zero until the first cleanup pass completes
+	ItemCount   int       // live items, as returned by Len
+}
+
+// Health returns the current status of the cache and its cleanup routine
+func (cache *Cache[K, V]) Health() HealthStatus {
+	status := HealthStatus{
+		Running:   cache.cleanupRunning.Load() && !cache.closed.Load(),
+		ItemCount: cache.Len(),
+	}
+	if last := cache.lastCleanup.Load(); last != nil {
+		status.LastCleanup = last.at
+	}
+	return status
+}
+
+// cleanupRecord describes a completed cleanup pass
+type cleanupRecord struct {
+	at      time.Time
+	removed int
+}
+
+// LastCleanupStats returns how many expired items the last cleanup pass
+// removed and when it completed, or zero values if there hasn't been one
+func (cache *Cache[K, V]) LastCleanupStats() (removed int, at time.Time) {
+	last := cache.lastCleanup.Load()
+	if last == nil {
+		return 0, time.Time{}
+	}
+	return last.removed, last.at
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthTracksCleanupAndShutdown(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	status := cache.Health()
+	if !status.Running || status.ItemCount != 1 {
+		t.Fatalf("Health of a new cache: got %+v, want running with one item", status)
+	}
+
+	clock.Advance(time.Second)
+	cache.Purge()
+	if status := cache.Health(); !status.LastCleanup.Equal(clock.Now()) {
+		t.Fatalf("LastCleanup after Purge: got %s, want %s", status.LastCleanup, clock.Now())
+	}
+
+	cache.Shutdown()
+	if status := cache.Health(); status.Running {
+		t.Fatal("Running after Shutdown: got true")
+	}
+}
+
+func TestLastCleanupStatsCountsExpired(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if removed, at := cache.LastCleanupStats(); removed != 0 || !at.IsZero() {
+		t.Fatalf("before any cleanup: got %d at %s, want zero values", removed, at)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id), 5*time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	if err := cache.Set(newState("d"), time.Hour); err != nil {
+		t.Fatalf("Set d: %v", err)
+	}
+
+	clock.Advance(5 * time.Second)
+	cache.Purge()
+	if removed, at := cache.LastCleanupStats(); removed != 3 || !at.Equal(clock.Now()) {
+		t.Fatalf("got %d at %s, want 3 at %s", removed, at, clock.Now())
+	}
+}
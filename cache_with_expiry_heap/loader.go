@@ -0,0 +1,139 @@
+package main
+
+import "time"
+
+// Loader fetches the value for a key from a backing store, such as a database,
+// when it isn't in the cache
+type Loader[K comparable, V any] interface {
+	Load(key K) (V, error)
+}
+
+// WithLoader makes the cache read-through, so that a Get which misses loads
+// the value from l and caches it for ttl before returning it. Concurrent
+// misses on the same key share a single Load, and errors aren't cached
+func WithLoader[K comparable, V any](l Loader[K, V], ttl time.Duration) Option {
+	return func(c *config) {
+		c.loader = l
+		c.loaderTTL = ttl
+	}
+}
+
+// WithStaleWindow lets Get keep serving an item for up to d after it expires,
+// while it is reloaded in the background, so that callers don't wait on the
+// loader for hot keys. Only one reload of a key runs at a time, and once it
+// completes the fresh value replaces the stale one with a new TTL. It has no
+// effect without a loader set by WithLoader
+func WithStaleWindow(d time.Duration) Option {
+	return func(c *config) {
+		c.staleWindow = max(d, 0)
+	}
+}
+
+// readThrough loads key from the configured loader and caches the result
+func (cache *Cache[K, V]) readThrough(key K) (V, error) {
+	return cache.loads.do(key, func() (V, error) {
+		return cache.loadAndStore(key)
+	})
+}
+
+// refresh reloads key in the background, unless a load of it is already in
+// flight. There is no caller waiting on the result, so failures are logged
+func (cache *Cache[K, V]) refresh(key K) {
+	cache.loads.join(key, func() (V, error) {
+		value, err := cache.loadAndStore(key)
+		if err != nil {
+			cache.logger.Printf("refreshing item %v failed: %s", key, err)
+		}
+		return value, err
+	})
+}
+
+func (cache *Cache[K, V]) loadAndStore(key K) (V, error) {
+	value, err := cache.loader.Load(key)
+	if err != nil {
+		return value, err
+	}
+	// the value came from the backing store, so don't write it back
+	if err := cache.set(key, value, cache.config.loaderTTL, false); err != nil {
+		return value, err
+	}
+	return value, nil
+}
+
+// stale returns the value of an expired item which is still within the stale
+// window, so can be served while it is refreshed
+func (cache *Cache[K, V]) stale(key K) (V, bool) {
+	var zero V
+
+	shard := cache.shardFor(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	item, exists := shard.items[key]
+	if !exists || item.missing || cache.closed.Load() {
+		return zero, false
+	}
+	now := cache.clock.Now().Unix()
+	if !item.expired(now) || item.expired(cache.staleCutoff(now)) {
+		return zero, false
+	}
+	return item.value, true
+}
+
+// staleCutoff returns the time by which an item must have expired to be past
+// the stale window, and so be due for removal. Without a window it is now
+func (cache *Cache[K, V]) staleCutoff(now int64) int64 {
+	return now - int64(cache.config.staleWindow.Seconds())
+}
+
+// WithRefreshAhead reloads items from l in the background once they are
+// within before of expiring, replacing them with the fresh value and a new
+// lifespan the same as the old one, so that hot items are never missing from
+// the cache. Items are checked on each cleanup pass, and only one refresh of
+// a key runs at a time. Items given a new expiry by Touch or Expire are renewed
+// for however long they were last extended by
+func WithRefreshAhead[K comparable, V any](before time.Duration, l Loader[K, V]) Option {
+	return func(c *config) {
+		c.refreshAhead = max(before, 0)
+		c.refreshLoader = l
+	}
+}
+
+// refreshAheadOfExpiry starts a background reload of every live item due to
+// expire within the refresh-ahead window
+func (cache *Cache[K, V]) refreshAheadOfExpiry() {
+	if cache.refresher == nil {
+		return
+	}
+
+	type due struct {
+		key      K
+		lifespan time.Duration
+	}
+
+	now := cache.clock.Now().Unix()
+	horizon := now + int64(cache.config.refreshAhead.Seconds())
+	var refreshing []due
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for _, entry := range shard.expirations {
+			item, exists := shard.items[entry.itemKey]
+			if exists && item.live(now) && item.lifespan > 0 && entry.unixExpiryTime <= horizon {
+				refreshing = append(refreshing, due{entry.itemKey, item.lifespan})
+			}
+		}
+		shard.RUnlock()
+	}
+
+	for _, d := range refreshing {
+		cache.refreshes.join(d.key, func() (V, error) {
+			value, err := cache.refresher.Load(d.key)
+			if err != nil {
+				cache.logger.Printf("refreshing item %v ahead of expiry failed: %s", d.key, err)
+				return value, err
+			}
+			// the value came from the backing store, so don't write it back
+			return value, cache.set(d.key, value, d.lifespan, false)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLoader loads a state for any id, once release is closed, counting
+// how many loads it has been asked for
+type countingLoader struct {
+	calls   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func newCountingLoader() *countingLoader {
+	return &countingLoader{release: make(chan struct{})}
+}
+
+func (l *countingLoader) Load(id string) (*MyState, error) {
+	l.calls.Add(1)
+	<-l.release
+	if l.err != nil {
+		return nil, l.err
+	}
+	return newState(id, int(l.calls.Load())), nil
+}
+
+func TestLoaderCalledOnceForConcurrentMisses(t *testing.T) {
+	loader := newCountingLoader()
+	cache, _ := newTestCache(t, WithStateLoader(loader, time.Minute))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if state, err := cache.Get("a"); err != nil || state.Id != "a" {
+				t.Errorf("Get: got %v, %v", state, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let both Gets miss
+	close(loader.release)
+	wg.Wait()
+
+	if got := loader.calls.Load(); got != 1 {
+		t.Fatalf("Load called %d times, want once", got)
+	}
+	if !cache.Has("a") {
+		t.Fatal("loaded state was not cached")
+	}
+}
+
+func TestLoaderErrorsAreNotCached(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	loader := newCountingLoader()
+	loader.err = errBackend
+	close(loader.release)
+	cache, _ := newTestCache(t, WithStateLoader(loader, time.Minute))
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Get("a"); !errors.Is(err, errBackend) {
+			t.Fatalf("Get %d: got %v, want the loader's error", i, err)
+		}
+	}
+	if got := loader.calls.Load(); got != 2 {
+		t.Fatalf("Load called %d times, want each Get to retry", got)
+	}
+}
+
+func TestLoaderPanicIsReturnedAsAnError(t *testing.T) {
+	cache, _ := newTestCache(t)
+	release := make(chan struct{})
+	panicking := func() (*MyState, error) {
+		<-release
+		panic("loader failed")
+	}
+
+	// both callers share the panicking load, and neither must be left waiting
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.GetOrSet("a", time.Minute, panicking); !errors.Is(err, ErrLoaderPanicked) {
+				t.Errorf("GetOrSet: got %v, want ErrLoaderPanicked", err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let both callers join the load
+	close(release)
+	wg.Wait()
+
+	// the failed load mustn't be left in flight for later callers
+	state, err := cache.GetOrSet("a", time.Minute, func() (*MyState, error) {
+		return newState("a"), nil
+	})
+	if err != nil || state.Id != "a" {
+		t.Fatalf("GetOrSet after the panic: got %v, %v", state, err)
+	}
+}
+
+func TestStaleValueServedWhileRefreshed(t *testing.T) {
+	loader := newCountingLoader()
+	close(loader.release)
+	cache, clock := newTestCache(t, WithStateLoader(loader, 10*time.Second), WithStaleWindow(30*time.Second))
+
+	if state, err := cache.Get("a"); err != nil || state.Values[0] != 1 {
+		t.Fatalf("first Get: got %v, %v, want the first load", state, err)
+	}
+
+	clock.Advance(11 * time.Second)
+	state, err := cache.Get("a")
+	if err != nil || state.Values[0] != 1 {
+		t.Fatalf("Get within the stale window: got %v, %v, want the stale first load", state, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if state, err := cache.Get("a"); err == nil && state.Values[0] == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale value was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ttl, err := cache.TTL("a"); err != nil || ttl != 10*time.Second {
+		t.Fatalf("TTL of the refreshed value: got %s, %v, want a fresh 10s", ttl, err)
+	}
+}
+
+func TestRefreshAheadReloadsBeforeExpiry(t *testing.T) {
+	loader := newCountingLoader()
+	close(loader.release)
+	cache, clock := newTestCache(t, WithRefreshAhead[string, *MyState](5*time.Second, loader))
+
+	if err := cache.Set(newState("a"), 10*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// outside the window nothing is refreshed
+	clock.Advance(4 * time.Second)
+	cache.Purge()
+	if got := loader.calls.Load(); got != 0 {
+		t.Fatalf("loader called %d times 6s before expiry, want 0", got)
+	}
+
+	clock.Advance(4 * time.Second)
+	cache.Purge()
+	eventually(t, time.Second, func() bool {
+		state, ok := cache.Peek("a")
+		return ok && len(state.Values) == 1
+	})
+
+	// the refresh renewed the full 10s lifespan, so the item outlives its
+	// original expiry
+	clock.Advance(4 * time.Second)
+	cache.Purge()
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get after the original expiry: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+// Logger receives the cache's diagnostic messages. *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+// NopLogger discards everything, silencing the cache's output
+type NopLogger struct{}
+
+func (NopLogger) Printf(string, ...any) {}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps every message it is given
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+// logged reports whether any message contains substr
+func (l *recordingLogger) logged(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, message := range l.messages {
+		if strings.Contains(message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMessagesGoToTheLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	cache, clock := newTestCache(t, WithLogger(logger))
+
+	if err := cache.Set(newState("a"), time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+	cache.Shutdown()
+
+	for _, want := range []string{"cleaning", "deleted item a", "shutting down"} {
+		if !logger.logged(want) {
+			t.Errorf("no message containing %q", want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+// MetricsSink receives metrics from a Collector. Counters only ever go up,
+// while gauges may go either way, matching Prometheus's metric types so that
+// a sink can be an adapter onto a Prometheus registry or any other backend
+type MetricsSink interface {
+	Counter(name string, value float64)
+	Gauge(name string, value float64)
+}
+
+// Collector exports a cache's counters and sizes to a MetricsSink, with each
+// metric name starting with the prefix given to Cache.Collector
+type Collector struct {
+	prefix  string
+	collect func(prefix string, sink MetricsSink)
+}
+
+// Collector returns a Collector exporting this cache's metrics under prefix,
+// such as "state_cache" for metrics named "state_cache_hits_total"
+func (cache *Cache[K, V]) Collector(prefix string) *Collector {
+	return &Collector{
+		prefix:  prefix,
+		collect: cache.collectMetrics,
+	}
+}
+
+// Collect reports the current value of every metric to sink, and is intended
+// to be called on each scrape
+func (c *Collector) Collect(sink MetricsSink) {
+	c.collect(c.prefix, sink)
+}
+
+func (cache *Cache[K, V]) collectMetrics(prefix string, sink MetricsSink) {
+	stats := cache.Stats()
+	sink.Counter(prefix+"_hits_total", float64(stats.Hits))
+	sink.Counter(prefix+"_misses_total", float64(stats.Misses))
+	sink.Counter(prefix+"_evictions_total", float64(stats.Evictions))
+	sink.Counter(prefix+"_expirations_total", float64(stats.Expirations))
+
+	sink.Gauge(prefix+"_items", float64(cache.Len()))
+	sink.Gauge(prefix+"_size_bytes", float64(cache.SizeBytes()))
+	sink.Gauge(prefix+"_heap_length", float64(cache.heapLen()))
+}
+
+// heapLen returns the number of entries across every shard's expiration heap
+func (cache *Cache[K, V]) heapLen() int {
+	total := 0
+	for _, shard := range cache.shards {
+		shard.RLock()
+		total += shard.expirations.Len()
+		shard.RUnlock()
+	}
+	return total
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+// mapSink records the latest value reported for each metric
+type mapSink map[string]float64
+
+func (s mapSink) Counter(name string, value float64) { s[name] = value }
+func (s mapSink) Gauge(name string, value float64)   { s[name] = value }
+
+func TestCollectorExportsMetrics(t *testing.T) {
+	cache, clock := newTestCache(t, WithMaxItems(2))
+
+	for _, id := range []string{"a", "b", "c"} { // c evicts one of a or b
+		if err := cache.Set(newState(id), time.Minute); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	if err := cache.Set(newState("permanent"), 0); err != nil {
+		t.Fatalf("Set permanent: %v", err)
+	}
+	_, _ = cache.Get("permanent")
+	_, _ = cache.Get("missing")
+	clock.Advance(time.Minute)
+	cache.Purge()
+
+	sink := mapSink{}
+	cache.Collector("state_cache").Collect(sink)
+
+	// adding the permanent item evicted another, and the remaining item with
+	// a lifespan expired
+	want := mapSink{
+		"state_cache_hits_total":        1,
+		"state_cache_misses_total":      1,
+		"state_cache_evictions_total":   2,
+		"state_cache_expirations_total": 1,
+		"state_cache_items":             1,
+		"state_cache_size_bytes":        0,
+		"state_cache_heap_length":       0,
+	}
+	if !maps.Equal(sink, want) {
+		t.Fatalf("got %v, want %v", sink, want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StateNamespace is a view of a MyStateCache holding only the states in one
+// namespace. States are stored under their Id prefixed with the namespace, so
+// the same Id can be used in different namespaces without colliding. The
+// prefix starts with the name's length, so that no namespace's keys can be
+// mistaken for another's, such as "a" with Id "b:x" and "a:b" with Id "x"
+type StateNamespace struct {
+	cache  *MyStateCache
+	prefix string
+}
+
+// Namespace returns a handle for the states in the named namespace
+func (cache *MyStateCache) Namespace(name string) *StateNamespace {
+	return &StateNamespace{
+		cache:  cache,
+		prefix: strconv.Itoa(len(name)) + ":" + name + ":",
+	}
+}
+
+// ClearNamespace removes every state in the named namespace, leaving the
+// rest of the cache alone, and returns how many were removed
+func (cache *MyStateCache) ClearNamespace(name string) int {
+	return cache.Namespace(name).Clear()
+}
+
+// Set stores state under its Id within the namespace
+func (ns *StateNamespace) Set(state *MyState, lifespan time.Duration) error {
+	if state == nil {
+		return ErrNilState
+	}
+
+	return ns.cache.Cache.Set(ns.prefix+state.Id, state, lifespan)
+}
+
+// Get returns the state stored under id within the namespace. A loader set
+// with WithStateLoader knows nothing of namespaces, so it isn't used here and
+// a miss is returned as is, rather than loading the wrong state
+func (ns *StateNamespace) Get(id string) (*MyState, error) {
+	return ns.cache.lookup(ns.prefix + id)
+}
+
+// Delete removes the state stored under id within the namespace
+func (ns *StateNamespace) Delete(id string) error {
+	return ns.cache.Delete(ns.prefix + id)
+}
+
+// Keys returns the ids of the live states in the namespace, without the
+// namespace prefix
+func (ns *StateNamespace) Keys() []string {
+	var ids []string
+	for _, key := range ns.cache.Keys() {
+		if id, ok := strings.CutPrefix(key, ns.prefix); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Range calls fn for each live state in the namespace, with its id without
+// the namespace prefix, stopping early if fn returns false
+func (ns *StateNamespace) Range(fn func(id string, state *MyState) bool) {
+	ns.cache.Range(func(key string, state *MyState) bool {
+		id, ok := strings.CutPrefix(key, ns.prefix)
+		if !ok {
+			return true
+		}
+		return fn(id, state)
+	})
+}
+
+// Clear removes every state in the namespace, returning how many were removed
+func (ns *StateNamespace) Clear() int {
+	return ns.cache.deleteWhere(func(key string, _ *MyState) bool {
+		return strings.HasPrefix(key, ns.prefix)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNamespacesDontCollide(t *testing.T) {
+	cache, _ := newTestCache(t)
+	users, orders := cache.Namespace("users"), cache.Namespace("orders")
+
+	if err := users.Set(newState("1", 10), time.Minute); err != nil {
+		t.Fatalf("users Set: %v", err)
+	}
+	if err := orders.Set(newState("1", 20), time.Minute); err != nil {
+		t.Fatalf("orders Set: %v", err)
+	}
+
+	for _, tc := range []struct {
+		ns   *StateNamespace
+		want int
+	}{{users, 10}, {orders, 20}} {
+		state, err := tc.ns.Get("1")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if state.Values[0] != tc.want {
+			t.Errorf("got %d, want %d", state.Values[0], tc.want)
+		}
+	}
+	if keys := users.Keys(); !slices.Equal(keys, []string{"1"}) {
+		t.Errorf("users Keys: got %v, want [1]", keys)
+	}
+}
+
+func TestNamespacesWithColonsDontCollide(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	// joined with a colon these would both be "a:b:x"
+	if err := cache.Namespace("a").Set(newState("b:x", 1), time.Minute); err != nil {
+		t.Fatalf("Set in a: %v", err)
+	}
+	if err := cache.Namespace("a:b").Set(newState("x", 2), time.Minute); err != nil {
+		t.Fatalf("Set in a:b: %v", err)
+	}
+
+	state, err := cache.Namespace("a").Get("b:x")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if state.Values[0] != 1 {
+		t.Fatalf("got %d, want 1 as set in namespace a", state.Values[0])
+	}
+	if keys := cache.Namespace("a:b").Keys(); !slices.Equal(keys, []string{"x"}) {
+		t.Fatalf("a:b Keys: got %v, want [x]", keys)
+	}
+}
+
+func TestClearNamespaceLeavesOthers(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	for _, name := range []string{"users", "orders"} {
+		if err := cache.Namespace(name).Set(newState("1"), time.Minute); err != nil {
+			t.Fatalf("Set in %s: %v", name, err)
+		}
+	}
+
+	if removed := cache.ClearNamespace("users"); removed != 1 {
+		t.Fatalf("ClearNamespace: got %d removed, want 1", removed)
+	}
+	if _, err := cache.Namespace("orders").Get("1"); err != nil {
+		t.Fatalf("orders Get: %v", err)
+	}
+	if got := cache.Len(); got != 1 {
+		t.Fatalf("Len: got %d, want 1", got)
+	}
+}
+
+func TestNamespaceGetSkipsTheLoader(t *testing.T) {
+	loader := newCountingLoader()
+	close(loader.release)
+	cache, _ := newTestCache(t, WithStateLoader(loader, time.Minute))
+	users := cache.Namespace("users")
+
+	if _, err := users.Get("1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get missing: got %v, want ErrNotFound", err)
+	}
+	if got := loader.calls.Load(); got != 0 {
+		t.Fatalf("Load called %d times for a namespaced miss, want none", got)
+	}
+}
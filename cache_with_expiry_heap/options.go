@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const defaultCleanupInterval = 20 * time.Second
+
+// config holds the tunable settings of a Cache. Hooks which depend on the
+// cache's key and value types are held as any, so that a single Option type
+// works for every Cache, and are checked by NewCache
+type config struct {
+	// runtime
+	cleanupInterval time.Duration
+	expiryJitter    time.Duration
+	defaultTTL      time.Duration // zero means unset
+	clock           Clock
+	logger          Logger
+	shards          int
+
+	// capacity
+	maxItems       int // zero means unbounded
+	maxBytes       int // zero means unbounded
+	sizer          any // func(V) int
+	validator      any // func(V) error
+	evictionPolicy EvictionPolicy
+
+	// debugging
+	consistencyChecks bool
+
+	// hooks
+	onExpire      any // func(K, V)
+	expiryGuard   any // func(K, V) (bool, time.Duration)
+	loader        any // Loader[K, V]
+	loaderTTL     time.Duration
+	staleWindow   time.Duration
+	refreshLoader any // Loader[K, V]
+	refreshAhead  time.Duration
+	writer        any // Writer[K, V]
+
+	behindWriter   any // Writer[K, V]
+	behindInterval time.Duration
+	behindMaxBatch int
+}
+
+// Option configures a Cache when passed to NewCache or NewMyStateCache. Every
+// option is optional, with anything left unset taking its default
+type Option func(*config)
+
+// defaultConfig is a cache swept every 20 seconds while idle, using the real
+// clock and standard logger, with a single shard and no capacity limits
+func defaultConfig() config {
+	return config{
+		cleanupInterval: defaultCleanupInterval,
+		clock:           realClock{},
+		logger:          log.Default(),
+		shards:          1,
+	}
+}
+
+// newConfig applies opts, in order, over the defaults
+func newConfig(opts []Option) config {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// hookFor returns a hook set by an option as the type the cache expects,
+// panicking if it was written for a cache with different key or value types
+func hookFor[T any](hook any, option string) T {
+	var typed T
+	if hook == nil {
+		return typed
+	}
+
+	typed, ok := hook.(T)
+	if !ok {
+		panic(fmt.Sprintf("%s: %T does not match the cache's key and value types", option, hook))
+	}
+	return typed
+}
+
+// WithCleanupInterval sets how long the cleanup routine waits before checking
+// again while there is nothing due to expire. A zero or negative interval is
+// ignored in favour of the default
+func WithCleanupInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d <= 0 {
+			d = defaultCleanupInterval
+		}
+		c.cleanupInterval = d
+	}
+}
+
+// WithDefaultTTL sets the lifespan used by SetDefault, so that it needn't be
+// repeated for every Set. A TTL of zero or less leaves it unset
+func WithDefaultTTL(d time.Duration) Option {
+	return func(c *config) {
+		c.defaultTTL = max(d, 0)
+	}
+}
+
+// WithExpiryJitter adds a random offset of up to max to the expiry of each
+// item set with a lifespan, so that items loaded together don't all expire
+// together. Expiries are tracked to the second, so max should be at least that
+func WithExpiryJitter(max time.Duration) Option {
+	return func(c *config) {
+		c.expiryJitter = max
+	}
+}
+
+// WithOnExpire registers a callback run for each item removed once it expires,
+// whether by the cleanup routine or on being found expired by Get,
+// GetAndDelete or Expire. It is called outside the cache lock, so may safely
+// use the cache
+func WithOnExpire[K comparable, V any](fn func(key K, value V)) Option {
+	return func(c *config) {
+		c.onExpire = fn
+	}
+}
+
+// WithExpiryGuard registers a check run on each item about to be removed for
+// expiring, whether by the cleanup routine, a read finding it expired or
+// Expire, which can keep it by returning true along with how long to extend it
+// for from now. As with Touch, an extend of zero or less keeps it permanently.
+// It runs under the cache lock, so must not use the cache, and a panic in it
+// is logged and treated as not keeping the item
+func WithExpiryGuard[K comparable, V any](fn func(key K, value V) (keep bool, extend time.Duration)) Option {
+	return func(c *config) {
+		c.expiryGuard = fn
+	}
+}
+
+// WithMaxItems caps the number of items held, evicting the least recently used
+// item, or another chosen by WithEvictionPolicy, when a Set would go over the
+// cap. A cap of zero or less is unbounded. With WithShards the cap is enforced
+// per shard rather than across the whole cache, see WithShards
+func WithMaxItems(n int) Option {
+	return func(c *config) {
+		c.maxItems = n
+	}
+}
+
+// EvictionPolicy decides which item is evicted when the cache is full
+type EvictionPolicy int
+
+const (
+	// PolicyLRU evicts the least recently used item, and is the default
+	PolicyLRU EvictionPolicy = iota
+
+	// PolicyLFU evicts the least frequently read item, the least recently
+	// used of them when several are tied
+	PolicyLFU
+)
+
+// WithEvictionPolicy sets how the item to evict is chosen once the cap set by
+// WithMaxItems is reached
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(c *config) {
+		c.evictionPolicy = p
+	}
+}
+
+// WithClock sets the source of the current time, which defaults to the real
+// clock. A nil clock is ignored
+func WithClock(c Clock) Option {
+	return func(cfg *config) {
+		if c != nil {
+			cfg.clock = c
+		}
+	}
+}
+
+// WithLogger routes the cache's messages to l instead of the standard logger,
+// pass NopLogger{} to silence them. A nil logger is ignored
+func WithLogger(l Logger) Option {
+	return func(c *config) {
+		if l != nil {
+			c.logger = l
+		}
+	}
+}
+
+// WithShards splits the cache into n independently locked shards, reducing
+// lock contention under heavy concurrent use. Values below one are ignored.
+// The item cap set by WithMaxItems is split evenly between shards, rounding up,
+// and each shard evicts once it reaches its own share. So the cache can hold
+// slightly more than the cap, up to the share times n, and a shard which keys
+// happen to favour can evict while the cache as a whole is under it
+func WithShards(n int) Option {
+	return func(c *config) {
+		if n >= 1 {
+			c.shards = n
+		}
+	}
+}
+
+// WithSizer sets the function used to estimate the size in bytes of each
+// value, which is tracked by SizeBytes and limited by WithMaxBytes
+func WithSizer[V any](fn func(value V) int) Option {
+	return func(c *config) {
+		c.sizer = fn
+	}
+}
+
+// WithValidator sets a check run on every value before it is stored, with
+// any error it returns being returned by the Set instead of storing the value.
+// In-place changes such as Update and CompareAndSwap are checked the same way,
+// leaving the old value in place if the new one is rejected. For example, a *MyState cache could reject states with an empty Id
+func WithValidator[V any](fn func(value V) error) Option {
+	return func(c *config) {
+		c.validator = fn
+	}
+}
+
+// WithConsistencyChecks makes every change to the cache check that each
+// shard's expiration heap still matches its items, panicking if they have
+// drifted apart. The check walks the whole shard, so this is a debugging aid
+// for development and is off by default
+func WithConsistencyChecks(enabled bool) Option {
+	return func(c *config) {
+		c.consistencyChecks = enabled
+	}
+}
+
+// WithMaxBytes limits the total estimated size of the cached items, as
+// measured by the sizer, evicting the items soonest to expire when a Set would
+// go over it. Like WithMaxItems, the limit is shared evenly between shards. A
+// limit of zero or less is unbounded
+func WithMaxBytes(n int) Option {
+	return func(c *config) {
+		c.maxBytes = n
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithCleanupIntervalFallsBackToDefault(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		if got := newConfig([]Option{WithCleanupInterval(d)}).cleanupInterval; got != defaultCleanupInterval {
+			t.Errorf("WithCleanupInterval(%s): got %s, want the default %s", d, got, defaultCleanupInterval)
+		}
+	}
+
+	if got := newConfig([]Option{WithCleanupInterval(time.Second)}).cleanupInterval; got != time.Second {
+		t.Errorf("WithCleanupInterval(1s): got %s", got)
+	}
+}
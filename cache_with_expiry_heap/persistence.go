@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// snapshotEntry is the persisted form of a single cached item
+type snapshotEntry[K comparable, V any] struct {
+	Key       K     `json:"key"`
+	Value     V     `json:"value"`
+	CachedAt  int64 `json:"cachedAt"`  // unix time
+	ExpiresAt int64 `json:"expiresAt"` // unix time, 0 for permanent items
+}
+
+// Save writes every live item, along with its expiry, to w as JSON so that
+// the cache can be warmed again with Load after a restart
+func (cache *Cache[K, V]) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(cache.entries())
+}
+
+// entries returns every live item along with when it was cached and expires.
+// Every shard is read locked together, so the result is a consistent view of
+// the cache at a single point in time
+func (cache *Cache[K, V]) entries() []snapshotEntry[K, V] {
+	for _, shard := range cache.shards {
+		shard.RLock()
+		defer shard.RUnlock()
+	}
+
+	now := cache.clock.Now().Unix()
+	var entries []snapshotEntry[K, V]
+	for _, shard := range cache.shards {
+		for key, item := range shard.items {
+			if !item.live(now) {
+				continue
+			}
+			entries = append(entries, snapshotEntry[K, V]{
+				Key:       key,
+				Value:     item.value,
+				CachedAt:  item.cachedAt,
+				ExpiresAt: item.expiresAt,
+			})
+		}
+	}
+	return entries
+}
+
+// Load reads items written by Save back into the cache. Each item keeps its
+// original expiry time, so it only lives for whatever remained of its
+// lifespan, and anything which expired while persisted is skipped
+func (cache *Cache[K, V]) Load(r io.Reader) error {
+	var entries []snapshotEntry[K, V]
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+
+	return cache.restore(entries, true)
+}
+
+// mergeFrom copies every live item in other into the cache, using copyValue,
+// keeping their original expiry times. Existing live items are only replaced
+// if overwrite is set. Other is snapshotted first, so the two caches' locks
+// are never held together
+func (cache *Cache[K, V]) mergeFrom(other *Cache[K, V], overwrite bool, copyValue func(value V) V) error {
+	entries := other.entries()
+	for i := range entries {
+		entries[i].Value = copyValue(entries[i].Value)
+	}
+	return cache.restore(entries, overwrite)
+}
+
+// restore stores entries with their original expiry times, skipping any which
+// have since expired, and only replacing existing live items if overwrite is set
+func (cache *Cache[K, V]) restore(entries []snapshotEntry[K, V], overwrite bool) error {
+	now := cache.clock.Now().Unix()
+	for _, entry := range entries {
+		if entry.ExpiresAt != neverExpires && entry.ExpiresAt <= now {
+			continue
+		}
+
+		lifespan := time.Duration(0)
+		if entry.ExpiresAt != neverExpires {
+			lifespan = time.Duration(entry.ExpiresAt-entry.CachedAt) * time.Second
+		}
+
+		if err := cache.restoreEntry(entry, lifespan, now, overwrite); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreEntry stores a single entry for restore, leaving an existing live
+// item in place unless overwrite is set
+func (cache *Cache[K, V]) restoreEntry(entry snapshotEntry[K, V], lifespan time.Duration, now int64, overwrite bool) error {
+	shard := cache.shardFor(entry.Key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if cache.closed.Load() {
+		return ErrClosed
+	}
+	if existing, exists := shard.items[entry.Key]; overwrite || !exists || !existing.live(now) {
+		cache.store(shard, entry.Key, entry.Value, entry.CachedAt, entry.ExpiresAt, lifespan)
+	}
+	return nil
+}
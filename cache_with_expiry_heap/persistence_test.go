@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a", 1, 2), 10*time.Second); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+	if err := cache.Set(newState("b", 3), 0); err != nil {
+		t.Fatalf("Set b: %v", err)
+	}
+	if err := cache.Set(newState("c"), time.Second); err != nil {
+		t.Fatalf("Set c: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+
+	var buf bytes.Buffer
+	if err := cache.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	restored, _ := newTestCache(t, WithClock(clock))
+	if err := restored.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	a, err := restored.Get("a")
+	if err != nil {
+		t.Fatalf("Get a: %v", err)
+	}
+	if !slices.Equal(a.Values, []int{1, 2}) {
+		t.Errorf("a.Values: got %v, want [1 2]", a.Values)
+	}
+	if ttl, err := restored.TTL("a"); err != nil || ttl != 8*time.Second {
+		t.Errorf("TTL a: got %s, %v, want what remained of its lifespan, 8s", ttl, err)
+	}
+	if !restored.Has("b") {
+		t.Error("permanent item b was not restored")
+	}
+	if _, err := restored.Get("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get c: got %v, want ErrNotFound as it expired before Save", err)
+	}
+}
+
+func TestLoadSkipsItemsExpiredWhilePersisted(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a"), 5*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := cache.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	clock.Advance(10 * time.Second)
+	restored, _ := newTestCache(t, WithClock(clock))
+	if err := restored.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := restored.Len(); got != 0 {
+		t.Fatalf("Len: got %d, want 0", got)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// cacheShard is one independently locked partition of a Cache, holding its
+// own items and expiration heap so that operations on keys in different shards
+// don't contend on the same lock
+type cacheShard[K comparable, V any] struct {
+	sync.RWMutex
+	items       map[K]*cachedItem[K, V]
+	expirations expirationQueue[K]   // min-heap to track item expirations
+	expiryMap   map[K]*itemExpiry[K] // track expiry entries for updates
+	bytes       int                  // total estimated size of items
+	checked     bool                 // verify after every change, see WithConsistencyChecks
+}
+
+func newCacheShard[K comparable, V any]() *cacheShard[K, V] {
+	shard := &cacheShard[K, V]{}
+	shard.dropAll()
+	return shard
+}
+
+// shardFor returns the shard owning key, chosen by an FNV hash of the key
+func (cache *Cache[K, V]) shardFor(key K) *cacheShard[K, V] {
+	if len(cache.shards) == 1 {
+		return cache.shards[0]
+	}
+
+	h := fnv.New32a()
+	switch k := any(key).(type) {
+	case string:
+		_, _ = h.Write([]byte(k))
+	default:
+		_, _ = fmt.Fprint(h, k)
+	}
+	return cache.shards[h.Sum32()%uint32(len(cache.shards))]
+}
+
+// scheduleExpiry adds, moves or removes the heap entry for key to match the
+// given expiry, reporting whether it is now the soonest to expire in the
+// shard. The caller must hold the write lock
+func (shard *cacheShard[K, V]) scheduleExpiry(key K, expiry int64) bool {
+	entry, exists := shard.expiryMap[key]
+	switch {
+	case expiry == neverExpires:
+		if exists {
+			heap.Remove(&shard.expirations, entry.index)
+			delete(shard.expiryMap, key)
+		}
+		shard.verify()
+		return false
+	case exists:
+		entry.unixExpiryTime = expiry
+		heap.Fix(&shard.expirations, entry.index)
+	default:
+		entry = &itemExpiry[K]{
+			itemKey:        key,
+			unixExpiryTime: expiry,
+		}
+		shard.expiryMap[key] = entry
+		heap.Push(&shard.expirations, entry)
+	}
+	shard.verify()
+
+	return shard.expirations[0] == entry
+}
+
+// remove drops an item from the map, heap and expiry tracking. The caller
+// must hold the write lock
+func (shard *cacheShard[K, V]) remove(key K) {
+	if item, exists := shard.items[key]; exists {
+		shard.bytes -= item.size
+	}
+	delete(shard.items, key)
+
+	if expiry, exists := shard.expiryMap[key]; exists {
+		if expiry.index >= 0 { // popped entries have an index of -1
+			heap.Remove(&shard.expirations, expiry.index)
+		}
+		delete(shard.expiryMap, key)
+	}
+	shard.verify()
+}
+
+// dropAll empties the map, heap and expiry tracking. The caller must hold
+// the write lock
+func (shard *cacheShard[K, V]) dropAll() {
+	shard.items = make(map[K]*cachedItem[K, V])
+	shard.expirations = make(expirationQueue[K], 0)
+	shard.expiryMap = make(map[K]*itemExpiry[K])
+	shard.bytes = 0
+	heap.Init(&shard.expirations)
+	shard.verify()
+}
+
+// drain empties the shard under its write lock, returning the items it held
+func (shard *cacheShard[K, V]) drain() []*cachedItem[K, V] {
+	shard.Lock()
+	defer shard.Unlock()
+
+	items := make([]*cachedItem[K, V], 0, len(shard.items))
+	for _, item := range shard.items {
+		items = append(items, item)
+	}
+	shard.dropAll()
+	return items
+}
+
+// leastRecentlyUsed returns the key of the lowest priority item accessed
+// longest ago. The caller must hold the write lock
+func (shard *cacheShard[K, V]) leastRecentlyUsed() K {
+	var lruKey K
+	lruPriority, lruAccess := math.MaxInt, int64(math.MaxInt64)
+	for key, item := range shard.items {
+		access := item.lastAccess.Load()
+		if item.priority < lruPriority || (item.priority == lruPriority && access < lruAccess) {
+			lruKey, lruPriority, lruAccess = key, item.priority, access
+		}
+	}
+	return lruKey
+}
+
+// leastFrequentlyUsed returns the key of the lowest priority item read the
+// fewest times, breaking ties by the one accessed longest ago. The caller must
+// hold the write lock
+func (shard *cacheShard[K, V]) leastFrequentlyUsed() K {
+	var lfuKey K
+	lfuPriority, lfuCount, lfuAccess := math.MaxInt, uint64(math.MaxUint64), int64(math.MaxInt64)
+	for key, item := range shard.items {
+		count, access := item.accessCount.Load(), item.lastAccess.Load()
+		fewer := count < lfuCount || (count == lfuCount && access < lfuAccess)
+		if item.priority < lfuPriority || (item.priority == lfuPriority && fewer) {
+			lfuKey, lfuPriority, lfuCount, lfuAccess = key, item.priority, count, access
+		}
+	}
+	return lfuKey
+}
+
+// popExpired removes and returns every item expiring at or before now. The
+// caller must hold the write lock
+func (shard *cacheShard[K, V]) popExpired(now int64) []*cachedItem[K, V] {
+	var expired []*cachedItem[K, V]
+	for shard.expirations.Len() > 0 {
+		earliest := shard.expirations[0] // Peek
+		if earliest.unixExpiryTime > now {
+			break
+		}
+		heap.Pop(&shard.expirations) // remove from heap
+		if item, exists := shard.items[earliest.itemKey]; exists {
+			expired = append(expired, item)
+			shard.bytes -= item.size
+		}
+		delete(shard.items, earliest.itemKey)     // remove from map
+		delete(shard.expiryMap, earliest.itemKey) // remove expiry tracking
+	}
+	shard.verify()
+	return expired
+}
+
+// verify panics if the expiration heap and expiry tracking have drifted from
+// the items they track, when consistency checks are on. Permanent items are
+// the only ones left out of the heap. The caller must hold the write lock
+func (shard *cacheShard[K, V]) verify() {
+	if !shard.checked {
+		return
+	}
+
+	expiring := 0
+	for _, item := range shard.items {
+		if item.expiresAt != neverExpires {
+			expiring++
+		}
+	}
+	if expiring != len(shard.expiryMap) || len(shard.expiryMap) != shard.expirations.Len() {
+		panic(fmt.Sprintf("cache shard out of sync: %d expiring items, %d expiry entries, %d heap entries",
+			expiring, len(shard.expiryMap), shard.expirations.Len()))
+	}
+
+	for key, entry := range shard.expiryMap {
+		item, exists := shard.items[key]
+		switch {
+		case !exists:
+			panic(fmt.Sprintf("cache shard out of sync: expiry entry for missing item %v", key))
+		case item.expiresAt != entry.unixExpiryTime:
+			panic(fmt.Sprintf("cache shard out of sync: item %v expires at %d but its entry says %d", key, item.expiresAt, entry.unixExpiryTime))
+		case entry.index < 0 || entry.index >= shard.expirations.Len() || shard.expirations[entry.index] != entry:
+			panic(fmt.Sprintf("cache shard out of sync: heap entry for item %v is at the wrong index", key))
+		}
+	}
+}
+
+// nextExpiry peeks at the soonest expiry in the shard, returning false if
+// nothing in it is due to expire
+func (shard *cacheShard[K, V]) nextExpiry() (int64, bool) {
+	shard.RLock()
+	defer shard.RUnlock()
+
+	if shard.expirations.Len() == 0 {
+		return 0, false
+	}
+	return shard.expirations[0].unixExpiryTime, true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCleanEmptiesExpiryTracking(t *testing.T) {
+	cache, clock := newTestCache(t, WithShards(4))
+
+	for i := 0; i < 20; i++ {
+		if err := cache.Set(newState(fmt.Sprintf("state#%d", i)), time.Second); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+
+	for i, shard := range cache.shards {
+		shard.RLock()
+		tracked, queued := len(shard.expiryMap), shard.expirations.Len()
+		shard.RUnlock()
+		if tracked != 0 || queued != 0 {
+			t.Errorf("shard %d after clean: %d expiry entries, %d heap entries, want none", i, tracked, queued)
+		}
+	}
+}
+
+func TestConsistencyChecksPassUnderNormalUse(t *testing.T) {
+	cache, clock := newTestCache(t, WithConsistencyChecks(true), WithMaxItems(8), WithShards(2))
+
+	// every kind of change, any of which panics if it leaves a shard out of
+	// sync
+	for i := 0; i < 12; i++ {
+		lifespan := time.Duration(i%3) * time.Second // some permanent
+		if err := cache.Set(newState(fmt.Sprintf("state#%d", i)), lifespan); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for _, id := range cache.Keys()[:4] {
+		if err := cache.Touch(id, time.Minute); err != nil {
+			t.Fatalf("Touch %s: %v", id, err)
+		}
+	}
+	if err := cache.SetMissing("missing", time.Second); err != nil {
+		t.Fatalf("SetMissing: %v", err)
+	}
+	for _, id := range cache.Keys()[:2] {
+		if err := cache.Delete(id); err != nil {
+			t.Fatalf("Delete %s: %v", id, err)
+		}
+	}
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+	cache.Resize(2)
+}
+
+func TestConsistencyChecksCatchDrift(t *testing.T) {
+	cache, _ := newTestCache(t, WithConsistencyChecks(true))
+	if err := cache.Set(newState("a"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// drop the item behind the heap's back, as a buggy change might
+	shard := cache.shardFor("a")
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.items, "a")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("verify didn't panic on a shard out of sync")
+		}
+	}()
+	shard.verify()
+}
+
+func TestFailedConsistencyCheckReleasesLock(t *testing.T) {
+	cache, _ := newTestCache(t, WithConsistencyChecks(true))
+	for _, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id), time.Minute); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+
+	shard := cache.shardFor("a")
+	shard.Lock()
+	delete(shard.items, "a")
+	shard.Unlock()
+
+	// evicting down to the new cap verifies the shard, which is still out
+	// of sync
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Resize didn't panic on a shard out of sync")
+			}
+		}()
+		cache.Resize(1)
+	}()
+
+	if !shard.TryLock() {
+		t.Fatal("shard left locked after a failed consistency check")
+	}
+	shard.Unlock()
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := NewCache[string, int](context.Background(), WithShards(shards), WithLogger(NopLogger{}))
+			defer cache.Shutdown()
+
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("state#%d", i)
+				_ = cache.Set(keys[i], i, time.Hour)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if i%4 == 0 {
+						_ = cache.Set(key, i, time.Hour)
+					} else {
+						_, _ = cache.Get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestMaxItemsIsEnforcedPerShard(t *testing.T) {
+	cache, clock := newTestCache(t, WithMaxItems(4), WithShards(2))
+
+	// three keys which all land in the first shard, whose share of the cap is two
+	var keys []string
+	for i := 0; len(keys) < 3; i++ {
+		if key := fmt.Sprintf("state#%d", i); cache.shardFor(key) == cache.shards[0] {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if err := cache.Set(newState(key), time.Minute); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+		clock.Advance(time.Second) // so the items are used at different times
+	}
+
+	if got := cache.Len(); got != 2 {
+		t.Fatalf("Len: got %d, want the shard held to its share of 2", got)
+	}
+	if cache.Has(keys[0]) {
+		t.Fatal("least recently used item in the full shard was not evicted")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// flightCall is a single in-progress load that other callers can wait on
+type flightCall[V any] struct {
+	done  chan struct{} // closed once value and err are set
+	value V
+	err   error
+}
+
+// flightGroup collapses concurrent loads of the same key into a single call,
+// so that a cache miss on a hot key doesn't stampede the underlying loader
+type flightGroup[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*flightCall[V]
+}
+
+func (g *flightGroup[K, V]) do(key K, fn func() (V, error)) (V, error) {
+	return g.doContext(context.Background(), key, fn)
+}
+
+// doContext is like do, but stops waiting once ctx is done. The load itself
+// carries on in the background, so other callers sharing it are unaffected
+func (g *flightGroup[K, V]) doContext(ctx context.Context, key K, fn func() (V, error)) (V, error) {
+	call := g.join(key, fn)
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// join returns the in-progress call for key, starting fn in the background
+// as a new call if there isn't one
+func (g *flightGroup[K, V]) join(key K, fn func() (V, error)) *flightCall[V] {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.calls == nil {
+		g.calls = make(map[K]*flightCall[V])
+	}
+	call, exists := g.calls[key]
+	if !exists {
+		call = &flightCall[V]{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.run(key, call, fn)
+	}
+	return call
+}
+
+// run makes the call, recovering a panic in fn as an error so that the call
+// still finishes, rather than crashing the program from a background goroutine
+// and leaving every waiter blocked
+func (g *flightGroup[K, V]) run(key K, call *flightCall[V], fn func() (V, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.err = fmt.Errorf("%w: %v", ErrLoaderPanicked, r)
+		}
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+
+		close(call.done)
+	}()
+
+	call.value, call.err = fn()
+}
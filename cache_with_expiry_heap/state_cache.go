@@ -1,166 +1,264 @@
 package main
 
 import (
-	"container/heap"
 	"context"
 	"errors"
-	"log"
-	"sync"
+	"fmt"
+	"reflect"
+	"slices"
 	"time"
 )
 
-type cachedItem struct {
-	stateObject *MyState
-	cachedAt    int64 // unix time
-	expiresAt   int64 // unix time
+var (
+	// ErrNilState is returned when attempting to cache a nil state
+	ErrNilState = errors.New("cannot cache state due to nil value")
+
+	// ErrIndexOutOfRange is returned when a value index is outside a state's Values
+	ErrIndexOutOfRange = errors.New("state value index out of range")
+)
+
+// MyStateCache is a Cache of MyState values keyed by their Id
+type MyStateCache struct {
+	*Cache[string, *MyState]
 }
 
-type itemExpiry struct {
-	itemKey        string
-	unixExpiryTime int64
-	index          int
+// NewMyStateCache creates a cache of states configured by opts, such as
+// WithCleanupInterval or WithMaxItems. Called without options it uses the
+// defaults, so NewMyStateCache(ctx) behaves as the original cache did
+func NewMyStateCache(ctx context.Context, opts ...Option) *MyStateCache {
+	return &MyStateCache{
+		Cache: NewCache[string, *MyState](ctx, opts...),
+	}
 }
 
-type expirationQueue []*itemExpiry
+// StateLoader fetches a state from a backing store by its Id, for use with
+// WithStateLoader
+type StateLoader interface {
+	Load(id string) (*MyState, error)
+}
 
-func (q *expirationQueue) Len() int {
-	return len(*q)
+// WithStateLoader is WithLoader for a MyStateCache, making it read-through
+// from l with loaded states cached for ttl
+func WithStateLoader(l StateLoader, ttl time.Duration) Option {
+	return WithLoader[string, *MyState](l, ttl)
 }
-func (q *expirationQueue) Less(i, j int) bool {
-	return (*q)[i].unixExpiryTime < (*q)[j].unixExpiryTime
+
+// StateWriter persists a state to a backing store, which it can key by the
+// state's Id, for use with WithStateWriter
+type StateWriter interface {
+	Write(state *MyState) error
 }
-func (q *expirationQueue) Swap(i, j int) {
-	(*q)[i], (*q)[j] = (*q)[j], (*q)[i]
-	(*q)[i].index = i
-	(*q)[j].index = j
+
+// stateWriter adapts a StateWriter to the Writer called by the cache
+type stateWriter struct {
+	w StateWriter
 }
-func (q *expirationQueue) Push(x interface{}) {
-	n := len(*q)
-	item := x.(*itemExpiry)
-	item.index = n
-	*q = append(*q, item)
+
+func (sw stateWriter) Write(_ string, state *MyState) error {
+	return sw.w.Write(state)
 }
-func (q *expirationQueue) Pop() interface{} {
-	old := *q
-	n := len(old)
-	item := old[n-1]
-	old[n-1] = nil  // allow for eventual GC
-	item.index = -1 // help prevent accidental re-use
-	*q = old[0 : n-1]
-	return item
+
+// WithStateWriter is WithWriter for a MyStateCache, making every Set first
+// write the state to w, failing without caching it if that write fails. As
+// with WithWriter, each Set then takes as long as the write
+func WithStateWriter(w StateWriter) Option {
+	return WithWriter[string, *MyState](stateWriter{w})
 }
 
-type MyStateCache struct {
-	sync.RWMutex
-	items       map[string]*cachedItem
-	expirations expirationQueue        // min-heap to track item expirations
-	expiryMap   map[string]*itemExpiry // track expiry entries for updates
-	ctx         context.Context
-	cancel      context.CancelFunc
-}
-
-func NewMyStateCache(ctx context.Context) *MyStateCache {
-	cacheCtx, cancel := context.WithCancel(ctx)
-	cache := &MyStateCache{
-		items:       make(map[string]*cachedItem),
-		expirations: make(expirationQueue, 0),
-		expiryMap:   make(map[string]*itemExpiry),
-		ctx:         cacheCtx,
-		cancel:      cancel,
+// Set stores state under its Id for the given lifespan
+func (cache *MyStateCache) Set(state *MyState, lifespan time.Duration) error {
+	if state == nil {
+		return ErrNilState
 	}
-	heap.Init(&cache.expirations)
-	go cache.startCleanup()
-	return cache
+
+	return cache.Cache.Set(state.Id, state, lifespan)
 }
 
-func (cache *MyStateCache) Set(state *MyState, lifespan time.Duration) error {
+// SetDefault stores state under its Id for the cache's default TTL, set with
+// WithDefaultTTL
+func (cache *MyStateCache) SetDefault(state *MyState) error {
 	if state == nil {
-		return errors.New("cannot cache state due to nil value")
+		return ErrNilState
 	}
 
-	cache.Lock()
-	defer cache.Unlock()
+	return cache.Cache.SetDefault(state.Id, state)
+}
 
-	cachedAt := time.Now().Unix()
-	expiry := cachedAt + int64(lifespan.Seconds())
+// SetWithPriority stores state under its Id for the given lifespan, with a
+// priority deciding which items are evicted first once the item cap is reached
+func (cache *MyStateCache) SetWithPriority(state *MyState, lifespan time.Duration, priority int) error {
+	if state == nil {
+		return ErrNilState
+	}
 
-	if oldExpiry, exists := cache.expiryMap[state.Id]; exists {
-		oldExpiry.unixExpiryTime = expiry
-		heap.Fix(&cache.expirations, oldExpiry.index)
-	} else {
-		expiryEntry := &itemExpiry{
-			itemKey:        state.Id,
-			unixExpiryTime: expiry,
-		}
-		cache.expiryMap[state.Id] = expiryEntry
-		heap.Push(&cache.expirations, expiryEntry)
+	return cache.Cache.SetWithPriority(state.Id, state, lifespan, priority)
+}
+
+// SetIfAbsent stores state under its Id only if there is no live state there
+// already, reporting whether it did
+func (cache *MyStateCache) SetIfAbsent(state *MyState, lifespan time.Duration) (bool, error) {
+	if state == nil {
+		return false, ErrNilState
 	}
 
-	cache.items[state.Id] = &cachedItem{
-		stateObject: state,
-		cachedAt:    cachedAt,
-		expiresAt:   expiry,
+	return cache.Cache.SetIfAbsent(state.Id, state, lifespan)
+}
+
+// Replace stores state under its Id only if a live state is already there,
+// returning ErrNotFound otherwise
+func (cache *MyStateCache) Replace(state *MyState, lifespan time.Duration) error {
+	if state == nil {
+		return ErrNilState
 	}
 
-	return nil
+	return cache.Cache.Replace(state.Id, state, lifespan)
 }
 
-func (cache *MyStateCache) Get(stateId string) (*MyState, error) {
-	cache.RLock()
-	defer cache.RUnlock()
+// CompareAndSwap replaces the live state stored under id with newState only if
+// the current state deep-equals oldState, reporting whether the swap happened
+func (cache *MyStateCache) CompareAndSwap(id string, oldState, newState *MyState) (bool, error) {
+	if newState == nil {
+		return false, ErrNilState
+	}
 
-	item, exists := cache.items[stateId]
-	if !exists {
-		return nil, errors.New("state item not found")
+	return cache.Cache.CompareAndSwap(id, oldState, newState)
+}
+
+// SetMany stores every state under its Id for the same lifespan, using a
+// single lock. A nil state fails the whole batch with ErrNilState
+func (cache *MyStateCache) SetMany(states []*MyState, lifespan time.Duration) error {
+	byId := make(map[string]*MyState, len(states))
+	for _, state := range states {
+		if state == nil {
+			return ErrNilState
+		}
+		byId[state.Id] = state
 	}
 
-	if item.expiresAt <= time.Now().Unix() {
-		return nil, errors.New("state item was found as expired")
+	return cache.Cache.SetMany(byId, lifespan)
+}
+
+// ImportMap stores every state in m under its Id for the same ttl, such as to
+// seed the cache. Every state is checked for nil and by any validator set with
+// WithValidator before anything is stored, so an invalid state leaves the
+// cache untouched. Like SetMany, each shard's lock is only taken once
+func (cache *MyStateCache) ImportMap(m map[string]*MyState, ttl time.Duration) error {
+	byId := make(map[string]*MyState, len(m))
+	for _, state := range m {
+		if state == nil {
+			return ErrNilState
+		}
+		byId[state.Id] = state
 	}
 
-	return item.stateObject, nil
+	return cache.Cache.SetMany(byId, ttl)
 }
 
-func (cache *MyStateCache) Shutdown() {
-	log.Print("shutting down cache...")
-	cache.RLock()
-	defer cache.RUnlock()
-	cache.items = nil
-	cache.expirations = make(expirationQueue, 0)
-	cache.expiryMap = make(map[string]*itemExpiry)
-	cache.cancel()
+// IncrementValue atomically adds delta to Values[index] of the cached state,
+// returning the new value. The stored state is replaced with an updated copy
+// rather than being changed in place, as earlier callers of Get may still be
+// reading it, and the item's expiry is left alone
+func (cache *MyStateCache) IncrementValue(id string, index, delta int) (int, error) {
+	updated, err := cache.Update(id, func(state *MyState) (*MyState, error) {
+		if index < 0 || index >= len(state.Values) {
+			return nil, fmt.Errorf("%w: index %d with %d values", ErrIndexOutOfRange, index, len(state.Values))
+		}
+		updated := state.Clone()
+		updated.Values[index] += delta
+		return updated, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return updated.Values[index], nil
+}
+
+// Clone returns an independent copy of the cache, running until ctx is
+// cancelled, holding deep copies of every live state. Changes to either cache,
+// or to the states read from it, don't affect the other
+func (cache *MyStateCache) Clone(ctx context.Context) *MyStateCache {
+	return &MyStateCache{
+		Cache: cache.clone(ctx, (*MyState).Clone),
+	}
 }
 
-func (cache *MyStateCache) startCleanup() {
-	ticker := time.NewTicker(20 * time.Second)
-	defer ticker.Stop()
+// DeleteWhere removes every live state for which pred returns true, returning
+// how many were removed. Each shard is write locked while it is checked, so
+// pred must not use the cache
+func (cache *MyStateCache) DeleteWhere(pred func(state *MyState) bool) int {
+	return cache.deleteWhere(func(_ string, state *MyState) bool {
+		return pred(state)
+	})
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			cache.clean()
-		case <-cache.ctx.Done():
-			log.Println("cache cleanup stopped")
-			return
+// MergeFrom copies deep copies of every live state in other into the cache,
+// each keeping whatever remained of its lifespan. States already live in the
+// cache are replaced if overwrite is set, and kept otherwise. It returns
+// ErrClosed if the cache has been shut down
+func (cache *MyStateCache) MergeFrom(other *MyStateCache, overwrite bool) error {
+	return cache.mergeFrom(other.Cache, overwrite, (*MyState).Clone)
+}
+
+// Diff compares the live states of the cache with those of other, returning
+// the Ids only found here, those only found in other, and those found in both
+// but with different values, each sorted. Both caches are snapshotted in turn,
+// so their locks are never held together
+func (cache *MyStateCache) Diff(other *MyStateCache) (onlyHere, onlyThere, differing []string) {
+	here := cache.snapshot(func(state *MyState) *MyState { return state })
+	there := other.snapshot(func(state *MyState) *MyState { return state })
+
+	for id, state := range here {
+		otherState, found := there[id]
+		switch {
+		case !found:
+			onlyHere = append(onlyHere, id)
+		case !reflect.DeepEqual(state, otherState):
+			differing = append(differing, id)
+		}
+	}
+	for id := range there {
+		if _, found := here[id]; !found {
+			onlyThere = append(onlyThere, id)
 		}
 	}
-}
 
-func (cache *MyStateCache) clean() {
-	cache.Lock()
-	defer cache.Unlock()
+	slices.Sort(onlyHere)
+	slices.Sort(onlyThere)
+	slices.Sort(differing)
+	return onlyHere, onlyThere, differing
+}
 
-	now := time.Now()
-	log.Printf("cleaning for expiries older than %s", now.Format("02/01/2006 15:04:05"))
+// Items returns a consistent snapshot of every live state keyed by Id. The
+// states are deep copies, so changing them or the map doesn't affect the cache
+func (cache *MyStateCache) Items() map[string]*MyState {
+	return cache.snapshot((*MyState).Clone)
+}
 
-	for cache.expirations.Len() > 0 {
-		earliest := cache.expirations[0] // Peek
-		if earliest.unixExpiryTime > now.Unix() {
-			break
+// AppendValues atomically appends vals to the Values of the cached state,
+// creating it for the default TTL set with WithDefaultTTL if there isn't one,
+// and returns a copy of the result. As with IncrementValue, the stored state
+// is replaced with an updated copy rather than being appended to in place
+func (cache *MyStateCache) AppendValues(id string, vals ...int) (*MyState, error) {
+	updated, err := cache.upsert(id, func(state *MyState, found bool) (*MyState, error) {
+		if !found {
+			return &MyState{Id: id, Values: append([]int(nil), vals...)}, nil
 		}
-		heap.Pop(&cache.expirations)          // remove from heap
-		delete(cache.items, earliest.itemKey) // remove from map
-		log.Printf("deleted item %v\n", earliest.itemKey)
+		updated := state.Clone()
+		updated.Values = append(updated.Values, vals...)
+		return updated, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated.Clone(), nil
+}
+
+// Clone returns a deep copy of the state, so that its Values aren't shared
+func (state *MyState) Clone() *MyState {
+	return &MyState{
+		Id:     state.Id,
+		Values: append([]int(nil), state.Values...),
 	}
-	log.Print("cache cleanup completed")
 }
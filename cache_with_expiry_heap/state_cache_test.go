@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIncrementValueConcurrently(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.Set(newState("counter", 0, 100), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	ttl, _ := cache.TTL("counter")
+
+	const goroutines, increments = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if _, err := cache.IncrementValue("counter", 1, 1); err != nil {
+					t.Errorf("IncrementValue: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, err := cache.Get("counter")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if want := 100 + goroutines*increments; state.Values[1] != want {
+		t.Fatalf("Values[1]: got %d, want %d", state.Values[1], want)
+	}
+	if after, _ := cache.TTL("counter"); after != ttl {
+		t.Errorf("TTL: got %s, want it left at %s", after, ttl)
+	}
+}
+
+func TestIncrementValueErrors(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if _, err := cache.IncrementValue("missing", 0, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing state: got %v, want ErrNotFound", err)
+	}
+
+	if err := cache.Set(newState("a", 1), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	for _, index := range []int{-1, 1} {
+		if _, err := cache.IncrementValue("a", index, 1); !errors.Is(err, ErrIndexOutOfRange) {
+			t.Errorf("index %d: got %v, want ErrIndexOutOfRange", index, err)
+		}
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.Set(newState("a", 1), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// a stale read no longer matches, so the swap fails
+	swapped, err := cache.CompareAndSwap("a", newState("a", 0), newState("a", 2))
+	if err != nil || swapped {
+		t.Fatalf("CAS against a stale value: got %t, %v, want false, nil", swapped, err)
+	}
+
+	// an equal copy of the current value matches
+	swapped, err = cache.CompareAndSwap("a", newState("a", 1), newState("a", 2))
+	if err != nil || !swapped {
+		t.Fatalf("CAS against the current value: got %t, %v, want true, nil", swapped, err)
+	}
+	if state, _ := cache.Get("a"); state.Values[0] != 2 {
+		t.Fatalf("after CAS: got %v, want [2]", state.Values)
+	}
+}
+
+func TestCompareAndSwapWithNilState(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	current := newState("a", 1)
+	if err := cache.Set(current, time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	swapped, err := cache.CompareAndSwap("a", current, nil)
+	if !errors.Is(err, ErrNilState) || swapped {
+		t.Fatalf("CAS to nil: got %t, %v, want false, ErrNilState", swapped, err)
+	}
+	if state, err := cache.Get("a"); err != nil || state != current {
+		t.Fatalf("after CAS to nil: got %v, %v, want the original state kept", state, err)
+	}
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.Set(newState("a", 1, 2), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	clone := cache.Clone(context.Background())
+	defer clone.Shutdown()
+
+	cloned, err := clone.Get("a")
+	if err != nil {
+		t.Fatalf("Get from clone: %v", err)
+	}
+	cloned.Values[0] = 100
+	if err := clone.Set(newState("b"), time.Minute); err != nil {
+		t.Fatalf("Set on clone: %v", err)
+	}
+
+	original, err := cache.Get("a")
+	if err != nil {
+		t.Fatalf("Get from original: %v", err)
+	}
+	if !slices.Equal(original.Values, []int{1, 2}) {
+		t.Errorf("original changed through the clone: got %v, want [1 2]", original.Values)
+	}
+	if cache.Has("b") {
+		t.Error("state set on the clone appeared in the original")
+	}
+}
+
+func TestSetIfAbsentStoresOnce(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	var stored atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := cache.SetIfAbsent(newState("a", i), time.Minute)
+			if err != nil {
+				t.Errorf("SetIfAbsent: %v", err)
+			}
+			if ok {
+				stored.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := stored.Load(); got != 1 {
+		t.Fatalf("%d goroutines stored, want only the first", got)
+	}
+}
+
+func TestSetIfAbsentReplacesExpired(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a", 1), time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(time.Second)
+
+	if ok, err := cache.SetIfAbsent(newState("a", 2), time.Minute); err != nil || !ok {
+		t.Fatalf("SetIfAbsent over an expired state: got %t, %v, want true, nil", ok, err)
+	}
+}
+
+func TestReplaceOnlyUpdatesExisting(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Replace(newState("a", 1), time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Replace missing: got %v, want ErrNotFound", err)
+	}
+	if cache.Has("a") {
+		t.Fatal("Replace created a missing state")
+	}
+
+	if err := cache.Set(newState("a", 1), 10*time.Second); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clock.Advance(5 * time.Second)
+	if err := cache.Replace(newState("a", 2), time.Minute); err != nil {
+		t.Fatalf("Replace existing: %v", err)
+	}
+
+	state, err := cache.Get("a")
+	if err != nil || state.Values[0] != 2 {
+		t.Fatalf("Get after Replace: got %v, %v, want the replacement", state, err)
+	}
+	if ttl, _ := cache.TTL("a"); ttl != time.Minute {
+		t.Fatalf("TTL after Replace: got %s, want it refreshed to 1m", ttl)
+	}
+}
+
+func TestValidatorRejectsEmptyIds(t *testing.T) {
+	errEmptyId := errors.New("state has no id")
+	cache, _ := newTestCache(t, WithValidator(func(state *MyState) error {
+		if state.Id == "" {
+			return errEmptyId
+		}
+		return nil
+	}))
+
+	if err := cache.Set(newState(""), time.Minute); !errors.Is(err, errEmptyId) {
+		t.Fatalf("Set with an empty id: got %v, want the validator's error", err)
+	}
+	if got := cache.Len(); got != 0 {
+		t.Fatalf("Len: got %d, want the rejected state left out", got)
+	}
+
+	if err := cache.Set(newState("a"), time.Minute); err != nil {
+		t.Fatalf("Set a valid state: %v", err)
+	}
+}
+
+func TestValidatorChecksUpdates(t *testing.T) {
+	errTooMany := errors.New("state has too many values")
+	cache, _ := newTestCache(t, WithDefaultTTL(time.Minute), WithValidator(func(state *MyState) error {
+		if len(state.Values) > 2 {
+			return errTooMany
+		}
+		return nil
+	}))
+	if err := cache.Set(newState("a", 1, 2), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if _, err := cache.AppendValues("a", 3); !errors.Is(err, errTooMany) {
+		t.Fatalf("AppendValues to a live state: got %v, want the validator's error", err)
+	}
+	if got, _ := cache.Get("a"); len(got.Values) != 2 {
+		t.Fatalf("values after a rejected append: got %v, want [1 2]", got.Values)
+	}
+	if _, err := cache.AppendValues("b", 1, 2, 3); !errors.Is(err, errTooMany) {
+		t.Fatalf("AppendValues creating a state: got %v, want the validator's error", err)
+	}
+	if cache.Has("b") {
+		t.Fatal("rejected state was created by AppendValues")
+	}
+}
+
+func TestItemsIsADeepCopy(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if err := cache.Set(newState("a", 1, 2), time.Minute); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+	if err := cache.Set(newState("expired"), time.Second); err != nil {
+		t.Fatalf("Set expired: %v", err)
+	}
+	clock.Advance(time.Second)
+
+	items := cache.Items()
+	if len(items) != 1 || items["a"] == nil {
+		t.Fatalf("Items: got %v, want only the live state a", items)
+	}
+
+	items["a"].Values[0] = 100
+	items["a"].Values = append(items["a"].Values, 3)
+	delete(items, "a")
+	items["b"] = newState("b")
+
+	state, err := cache.Get("a")
+	if err != nil || !slices.Equal(state.Values, []int{1, 2}) {
+		t.Fatalf("Get a: got %v, %v, want it unchanged", state, err)
+	}
+	if cache.Has("b") {
+		t.Fatal("state added to the snapshot appeared in the cache")
+	}
+}
+
+func TestAppendValuesConcurrently(t *testing.T) {
+	cache, _ := newTestCache(t, WithDefaultTTL(time.Minute))
+
+	const goroutines, appends = 8, 50
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				if _, err := cache.AppendValues("a", g*appends+i); err != nil {
+					t.Errorf("AppendValues: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, err := cache.Get("a")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got := slices.Sorted(slices.Values(state.Values))
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("got %d values, want every one of 0 to %d once", len(got), goroutines*appends-1)
+		}
+	}
+	if len(got) != goroutines*appends {
+		t.Fatalf("got %d values, want %d", len(got), goroutines*appends)
+	}
+}
+
+func TestAppendValuesReturnsACopy(t *testing.T) {
+	cache, _ := newTestCache(t, WithDefaultTTL(time.Minute))
+
+	appended, err := cache.AppendValues("a", 1, 2)
+	if err != nil {
+		t.Fatalf("AppendValues: %v", err)
+	}
+	appended.Values[0] = 100
+
+	state, err := cache.Get("a")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !slices.Equal(state.Values, []int{1, 2}) {
+		t.Fatalf("got %v, want [1 2] unaffected by changing the returned state", state.Values)
+	}
+}
+
+func TestDeleteWhereRemovesMatches(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	for i := range 6 {
+		if err := cache.Set(newState(fmt.Sprintf("s%d", i), i), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	removed := cache.DeleteWhere(func(state *MyState) bool { return state.Values[0]%2 == 0 })
+	if removed != 3 {
+		t.Fatalf("got %d removed, want 3", removed)
+	}
+	if keys := slices.Sorted(slices.Values(cache.Keys())); !slices.Equal(keys, []string{"s1", "s3", "s5"}) {
+		t.Fatalf("got %v left, want [s1 s3 s5]", keys)
+	}
+	// the heap no longer holds the removed items either
+	if soon := cache.ExpiringSoon(10); len(soon) != 3 {
+		t.Fatalf("ExpiringSoon: got %v, want only the 3 remaining items", soon)
+	}
+}
+
+func TestImportMapOfStates(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	if err := cache.ImportMap(states, time.Minute); err != nil {
+		t.Fatalf("ImportMap: %v", err)
+	}
+	for _, want := range states {
+		got, err := cache.Get(want.Id)
+		if err != nil {
+			t.Fatalf("Get %s: %v", want.Id, err)
+		}
+		if !slices.Equal(got.Values, want.Values) {
+			t.Errorf("%s: got %v, want %v", want.Id, got.Values, want.Values)
+		}
+	}
+}
+
+func TestImportMapIsAllOrNothing(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	m := map[string]*MyState{"a": newState("a"), "b": nil}
+	if err := cache.ImportMap(m, time.Minute); !errors.Is(err, ErrNilState) {
+		t.Fatalf("got %v, want ErrNilState", err)
+	}
+	if got := cache.Len(); got != 0 {
+		t.Fatalf("Len: got %d, want 0 as nothing should be stored", got)
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	for _, overwrite := range []bool{false, true} {
+		t.Run(fmt.Sprintf("overwrite=%t", overwrite), func(t *testing.T) {
+			cache, _ := newTestCache(t)
+			other, _ := newTestCache(t)
+
+			if err := cache.Set(newState("shared", 1), time.Minute); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			for _, state := range []*MyState{newState("shared", 2), newState("new", 3)} {
+				if err := other.Set(state, 30*time.Second); err != nil {
+					t.Fatalf("Set in other: %v", err)
+				}
+			}
+
+			if err := cache.MergeFrom(other, overwrite); err != nil {
+				t.Fatalf("MergeFrom: %v", err)
+			}
+
+			want := 1
+			if overwrite {
+				want = 2
+			}
+			if shared, _ := cache.Get("shared"); shared == nil || shared.Values[0] != want {
+				t.Errorf("shared: got %v, want Values[0] of %d", shared, want)
+			}
+			if ttl, err := cache.TTL("new"); err != nil || ttl != 30*time.Second {
+				t.Errorf("new: got TTL %s, %v, want the remaining 30s", ttl, err)
+			}
+
+			// the merged states are copies, not shared with other
+			merged, _ := cache.Get("new")
+			original, _ := other.Get("new")
+			if merged == original {
+				t.Error("merged state is the same pointer as other's")
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	cache, _ := newTestCache(t)
+	other, _ := newTestCache(t)
+
+	for _, state := range []*MyState{newState("same", 1), newState("changed", 1), newState("mine", 1)} {
+		if err := cache.Set(state, time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for _, state := range []*MyState{newState("same", 1), newState("changed", 2), newState("theirs", 1)} {
+		if err := other.Set(state, time.Minute); err != nil {
+			t.Fatalf("Set in other: %v", err)
+		}
+	}
+
+	onlyHere, onlyThere, differing := cache.Diff(other)
+	if !slices.Equal(onlyHere, []string{"mine"}) {
+		t.Errorf("onlyHere: got %v, want [mine]", onlyHere)
+	}
+	if !slices.Equal(onlyThere, []string{"theirs"}) {
+		t.Errorf("onlyThere: got %v, want [theirs]", onlyThere)
+	}
+	if !slices.Equal(differing, []string{"changed"}) {
+		t.Errorf("differing: got %v, want [changed]", differing)
+	}
+}
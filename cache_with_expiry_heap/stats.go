@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats is a point-in-time snapshot of the cache counters
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Sets        uint64
+	Evictions   uint64
+	Expirations uint64
+}
+
+// cacheCounters are updated atomically so that they can be read without
+// taking the cache lock
+type cacheCounters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	sets        atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+
+	// lifetimes of removed items, see AverageLifetime
+	lifetimeSeconds atomic.Int64
+	removals        atomic.Uint64
+}
+
+// Stats returns a snapshot of the cache's hit, miss, set, eviction and
+// expiration counts since it was created
+func (cache *Cache[K, V]) Stats() CacheStats {
+	return CacheStats{
+		Hits:        cache.counters.hits.Load(),
+		Misses:      cache.counters.misses.Load(),
+		Sets:        cache.counters.sets.Load(),
+		Evictions:   cache.counters.evictions.Load(),
+		Expirations: cache.counters.expirations.Load(),
+	}
+}
+
+// AverageLifetime returns how long items removed from the cache, by expiring,
+// being deleted or being evicted, lived on average from when they were cached.
+// Lifetimes are tracked to the second, and it returns zero until something
+// has been removed
+func (cache *Cache[K, V]) AverageLifetime() time.Duration {
+	removals := cache.counters.removals.Load()
+	if removals == 0 {
+		return 0
+	}
+	total := time.Duration(cache.counters.lifetimeSeconds.Load()) * time.Second
+	return total / time.Duration(removals)
+}
+
+// removed records the lifetime of an item removed from the cache and reports
+// its removal to watchers. Negative entries are skipped
+func (cache *Cache[K, V]) removed(eventType EventType, item *cachedItem[K, V]) {
+	if item.missing {
+		return
+	}
+	lifetime := cache.clock.Now().Unix() - item.cachedAt
+	cache.counters.lifetimeSeconds.Add(max(lifetime, 0))
+	cache.counters.removals.Add(1)
+	cache.notify(eventType, item)
+}
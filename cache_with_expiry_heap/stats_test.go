@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsCountsOperations(t *testing.T) {
+	cache, clock := newTestCache(t, WithMaxItems(2))
+
+	fill := func(id string, lifespan time.Duration) {
+		t.Helper()
+		clock.Advance(time.Second)
+		if err := cache.Set(newState(id), lifespan); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+
+	fill("a", 2*time.Second)
+	fill("b", time.Hour)
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("Get a: %v", err)
+	}
+	if _, err := cache.Get("missing"); err == nil {
+		t.Fatal("Get missing: want an error")
+	}
+
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+
+	fill("c", time.Hour)
+	fill("d", time.Hour) // over the cap of two, so evicts b
+
+	want := CacheStats{Hits: 1, Misses: 1, Sets: 4, Evictions: 1, Expirations: 1}
+	if got := cache.Stats(); got != want {
+		t.Fatalf("Stats: got %+v, want %+v", got, want)
+	}
+}
+
+func TestAverageLifetime(t *testing.T) {
+	cache, clock := newTestCache(t)
+
+	if got := cache.AverageLifetime(); got != 0 {
+		t.Fatalf("before any removals: got %s, want 0", got)
+	}
+
+	for i, id := range []string{"a", "b", "c"} {
+		if err := cache.Set(newState(id), time.Duration(i+1)*2*time.Second); err != nil {
+			t.Fatalf("Set %s: %v", id, err)
+		}
+	}
+	if err := cache.Set(newState("deleted"), time.Hour); err != nil {
+		t.Fatalf("Set deleted: %v", err)
+	}
+
+	// a, b and c live 2s, 4s and 6s, and deleted is removed after 4s
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+	if err := cache.Delete("deleted"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	cache.Purge()
+
+	const want, tolerance = 4 * time.Second, time.Second
+	if got := cache.AverageLifetime(); got < want-tolerance || got > want+tolerance {
+		t.Fatalf("got %s, want %s within %s", got, want, tolerance)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// EventType is the kind of change reported to a key's watchers
+type EventType int
+
+const (
+	EventSet EventType = iota
+	EventUpdate
+	EventDelete
+	EventExpire
+	EventEvict
+)
+
+// KeyEvent is a change to a watched key. Value holds the new value for set and
+// update events, and the value which was removed for the others
+type KeyEvent[K comparable, V any] struct {
+	Type  EventType
+	Key   K
+	Value V
+}
+
+// watchBuffer is how many events a watcher can fall behind by before further
+// events for it are dropped
+const watchBuffer = 16
+
+// watchRegistry holds the event channels of every watched key
+type watchRegistry[K comparable, V any] struct {
+	mu       sync.Mutex
+	byKey    map[K][]chan KeyEvent[K, V]
+	watching atomic.Int64 // lets notify skip the lock while nothing is watched
+	closed   bool
+}
+
+// WatchKey returns a channel receiving an event each time key is set, updated,
+// deleted, evicted or expires, along with a function to stop watching which
+// closes the channel. Events are sent without blocking the cache, so a watcher
+// which falls more than a few events behind misses the ones after. Every
+// watcher's channel is closed by Shutdown
+func (cache *Cache[K, V]) WatchKey(key K) (<-chan KeyEvent[K, V], func()) {
+	events := make(chan KeyEvent[K, V], watchBuffer)
+
+	w := &cache.watchers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		close(events)
+		return events, func() {}
+	}
+	if w.byKey == nil {
+		w.byKey = make(map[K][]chan KeyEvent[K, V])
+	}
+	w.byKey[key] = append(w.byKey[key], events)
+	w.watching.Add(1)
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() { w.remove(key, events) })
+	}
+}
+
+func (w *watchRegistry[K, V]) remove(key K, events chan KeyEvent[K, V]) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed { // already closed by closeAll
+		return
+	}
+	w.byKey[key] = slices.DeleteFunc(w.byKey[key], func(c chan KeyEvent[K, V]) bool {
+		return c == events
+	})
+	if len(w.byKey[key]) == 0 {
+		delete(w.byKey, key)
+	}
+	w.watching.Add(-1)
+	close(events)
+}
+
+func (w *watchRegistry[K, V]) notify(event KeyEvent[K, V]) {
+	if w.watching.Load() == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, events := range w.byKey[event.Key] {
+		// a slow watcher misses events rather than holding up the cache
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// closeAll closes every watcher's channel, after which no more can be added
+func (w *watchRegistry[K, V]) closeAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	for _, watchers := range w.byKey {
+		for _, events := range watchers {
+			close(events)
+		}
+	}
+	w.byKey = nil
+	w.watching.Store(0)
+}
+
+// notify tells any watchers of item's key about a change to it. Negative
+// entries from SetMissing have no value, so aren't reported
+func (cache *Cache[K, V]) notify(eventType EventType, item *cachedItem[K, V]) {
+	if item.missing {
+		return
+	}
+	cache.watchers.notify(KeyEvent[K, V]{Type: eventType, Key: item.key, Value: item.value})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event on events, failing the test if none
+// arrives within a second
+func nextEvent(t *testing.T, events <-chan KeyEvent[string, *MyState]) KeyEvent[string, *MyState] {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("events closed, want another event")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event within a second")
+	}
+	return KeyEvent[string, *MyState]{}
+}
+
+func TestWatchKeySeesSetAndDelete(t *testing.T) {
+	cache, _ := newTestCache(t)
+
+	events, stop := cache.WatchKey("a")
+	if err := cache.Set(newState("other"), time.Minute); err != nil {
+		t.Fatalf("Set other: %v", err)
+	}
+	if err := cache.Set(newState("a", 1), time.Minute); err != nil {
+		t.Fatalf("Set a: %v", err)
+	}
+	if err := cache.Delete("a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// changes to other keys aren't seen, so the set is the first event
+	if event := nextEvent(t, events); event.Type != EventSet || event.Key != "a" {
+		t.Fatalf("first event: got %v for %q, want EventSet for a", event.Type, event.Key)
+	}
+	event := nextEvent(t, events)
+	if event.Type != EventDelete || event.Value.Values[0] != 1 {
+		t.Fatalf("second event: got %v with %v, want EventDelete with the removed state", event.Type, event.Value)
+	}
+
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatal("got an event after stopping, want the channel closed")
+	}
+}
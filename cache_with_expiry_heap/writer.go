@@ -0,0 +1,137 @@
+package main
+
+import "time"
+
+// Writer persists a value to a backing store, such as a database, when it is
+// set in the cache
+type Writer[K comparable, V any] interface {
+	Write(key K, value V) error
+}
+
+// WithWriter makes the cache write-through, so that every Set first writes the
+// value to w and fails, without caching it, if that write fails. This keeps
+// the cache and store consistent at the cost of each Set taking as long as the
+// write, during which the key's shard stays locked
+func WithWriter[K comparable, V any](w Writer[K, V]) Option {
+	return func(c *config) {
+		c.writer = w
+	}
+}
+
+// writeThrough passes value to the writer, if there is one
+func (cache *Cache[K, V]) writeThrough(key K, value V) error {
+	if cache.writer == nil {
+		return nil
+	}
+	return cache.writer.Write(key, value)
+}
+
+// WithWriteBehind makes Set return as soon as the value is cached, queuing it
+// to be written to w in the background. Queued values are written every
+// flushInterval, or as soon as maxBatch of them are waiting, with a key set
+// more than once in that time only written with its latest value. Shutdown
+// writes anything still queued before returning. Write errors are logged, as
+// there is no caller left to return them to
+func WithWriteBehind[K comparable, V any](w Writer[K, V], flushInterval time.Duration, maxBatch int) Option {
+	return func(c *config) {
+		if flushInterval <= 0 {
+			flushInterval = time.Second
+		}
+		if maxBatch < 1 {
+			maxBatch = 1
+		}
+		c.behindWriter = w
+		c.behindInterval = flushInterval
+		c.behindMaxBatch = maxBatch
+	}
+}
+
+// pendingWrite is a value waiting to be written behind
+type pendingWrite[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// writeBehindQueue buffers values set in the cache until they are flushed to
+// its writer
+type writeBehindQueue[K comparable, V any] struct {
+	writer   Writer[K, V]
+	pending  chan pendingWrite[K, V]
+	maxBatch int
+	flushed  chan struct{} // closed once the final flush has completed
+}
+
+func newWriteBehindQueue[K comparable, V any](w Writer[K, V], maxBatch int) *writeBehindQueue[K, V] {
+	return &writeBehindQueue[K, V]{
+		writer:   w,
+		pending:  make(chan pendingWrite[K, V], maxBatch),
+		maxBatch: maxBatch,
+		flushed:  make(chan struct{}),
+	}
+}
+
+// writeBehind queues a value for the background writer, if there is one. It
+// is called under the shard lock, so that Shutdown can't miss a value queued
+// by a Set which is still in progress, and blocks while the queue is full.
+// Once the cache's context is cancelled the background writer stops taking
+// values, so rather than blocking forever with the lock held, a value which
+// doesn't fit is logged and dropped
+func (cache *Cache[K, V]) writeBehind(key K, value V) {
+	if cache.behind == nil {
+		return
+	}
+
+	write := pendingWrite[K, V]{key, value}
+	select {
+	case cache.behind.pending <- write:
+		return
+	default:
+	}
+	select {
+	case cache.behind.pending <- write:
+	case <-cache.ctx.Done():
+		cache.logger.Printf("write behind dropped for item %v: cache stopped", key)
+	}
+}
+
+// runWriteBehind collects queued values into batches and flushes them to the
+// writer, until the cache is shut down and the queue has been drained
+func (cache *Cache[K, V]) runWriteBehind(interval time.Duration) {
+	defer close(cache.behind.flushed)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make(map[K]V)
+	for {
+		select {
+		case write := <-cache.behind.pending:
+			batch[write.key] = write.value
+			if len(batch) >= cache.behind.maxBatch {
+				cache.flushWrites(batch)
+			}
+		case <-ticker.C:
+			cache.flushWrites(batch)
+		case <-cache.ctx.Done():
+			for {
+				select {
+				case write := <-cache.behind.pending:
+					batch[write.key] = write.value
+				default:
+					cache.flushWrites(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flushWrites writes and then empties the batch
+func (cache *Cache[K, V]) flushWrites(batch map[K]V) {
+	for key, value := range batch {
+		if err := cache.behind.writer.Write(key, value); err != nil {
+			cache.logger.Printf("write behind failed for item %v: %s", key, err)
+		}
+		delete(batch, key)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stateWriterFunc lets a function be used as a StateWriter
+type stateWriterFunc func(state *MyState) error
+
+func (f stateWriterFunc) Write(state *MyState) error {
+	return f(state)
+}
+
+func TestFailingWriterFailsSet(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	cache, _ := newTestCache(t, WithStateWriter(stateWriterFunc(func(state *MyState) error {
+		if state.Id == "bad" {
+			return errBackend
+		}
+		return nil
+	})))
+
+	if err := cache.Set(newState("bad"), time.Minute); !errors.Is(err, errBackend) {
+		t.Fatalf("Set: got %v, want the writer's error", err)
+	}
+	if cache.Has("bad") {
+		t.Fatal("state was cached despite the write failing")
+	}
+
+	if err := cache.Set(newState("good"), time.Minute); err != nil {
+		t.Fatalf("Set with a successful write: %v", err)
+	}
+	if !cache.Has("good") {
+		t.Fatal("state was not cached after a successful write")
+	}
+}
+
+func TestFailingWriterFailsUpdates(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	failing := false
+	cache, _ := newTestCache(t, WithStateWriter(stateWriterFunc(func(state *MyState) error {
+		if failing {
+			return errBackend
+		}
+		return nil
+	})))
+	if err := cache.Set(newState("a", 1), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	failing = true
+	if _, err := cache.IncrementValue("a", 0, 1); !errors.Is(err, errBackend) {
+		t.Fatalf("IncrementValue: got %v, want the writer's error", err)
+	}
+	if _, err := cache.AppendValues("a", 2); !errors.Is(err, errBackend) {
+		t.Fatalf("AppendValues: got %v, want the writer's error", err)
+	}
+	current, _ := cache.Get("a")
+	if swapped, err := cache.CompareAndSwap("a", current, newState("a", 5)); swapped || !errors.Is(err, errBackend) {
+		t.Fatalf("CompareAndSwap: got (%v, %v), want (false, the writer's error)", swapped, err)
+	}
+	if got, _ := cache.Get("a"); len(got.Values) != 1 || got.Values[0] != 1 {
+		t.Fatalf("values after failed writes: got %v, want [1]", got.Values)
+	}
+
+	failing = false
+	if _, err := cache.IncrementValue("a", 0, 1); err != nil {
+		t.Fatalf("IncrementValue with a successful write: %v", err)
+	}
+}
+
+// recordingWriter keeps the latest value written for each key
+type recordingWriter struct {
+	mu      sync.Mutex
+	written map[string]*MyState
+}
+
+func newRecordingWriter() *recordingWriter {
+	return &recordingWriter{written: make(map[string]*MyState)}
+}
+
+func (w *recordingWriter) Write(key string, state *MyState) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.written[key] = state
+	return nil
+}
+
+func (w *recordingWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.written)
+}
+
+func TestWriteBehindEventuallyWritesEverything(t *testing.T) {
+	writer := newRecordingWriter()
+	cache, _ := newTestCache(t, WithWriteBehind[string, *MyState](writer, 10*time.Millisecond, 100))
+
+	for i := 0; i < 10; i++ {
+		if err := cache.Set(newState(fmt.Sprintf("state#%d", i)), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for writer.count() < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 10 states written after a second", writer.count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteBehindWritesUpdates(t *testing.T) {
+	writer := newRecordingWriter()
+	cache, _ := newTestCache(t, WithWriteBehind[string, *MyState](writer, time.Hour, 100))
+
+	if err := cache.Set(newState("a", 1), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := cache.IncrementValue("a", 0, 41); err != nil {
+		t.Fatalf("IncrementValue: %v", err)
+	}
+	cache.Shutdown()
+
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if got := writer.written["a"]; got == nil || got.Values[0] != 42 {
+		t.Fatalf("written state: got %v, want the incremented value 42", got)
+	}
+}
+
+func TestShutdownDrainsWriteBehind(t *testing.T) {
+	writer := newRecordingWriter()
+	// neither the interval nor the batch size is reached, so only Shutdown
+	// flushes the queue
+	cache, _ := newTestCache(t, WithWriteBehind[string, *MyState](writer, time.Hour, 100))
+
+	for i := 0; i < 10; i++ {
+		if err := cache.Set(newState(fmt.Sprintf("state#%d", i)), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	cache.Shutdown()
+
+	if got := writer.count(); got != 10 {
+		t.Fatalf("%d of 10 states written by Shutdown", got)
+	}
+}
+
+func TestWriteBehindAfterContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cache := NewMyStateCache(ctx, WithLogger(NopLogger{}), WithWriteBehind[string, *MyState](newRecordingWriter(), time.Hour, 2))
+	cancel()
+
+	// with the background writer stopped, Sets beyond the queue's capacity
+	// must not block forever, and nor must Shutdown
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			err := cache.Set(newState(fmt.Sprintf("state#%d", i)), time.Minute)
+			if err != nil && !errors.Is(err, ErrClosed) {
+				t.Errorf("Set: %v", err)
+			}
+		}
+		cache.Shutdown()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Set or Shutdown blocked after the context was cancelled")
+	}
+}
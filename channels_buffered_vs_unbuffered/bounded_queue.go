@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrQueueClosed is returned when enqueueing to a closed BoundedQueue, or
+// dequeueing from one which has been closed and drained
+var ErrQueueClosed = errors.New("queue has been closed")
+
+// BoundedQueue is a FIFO queue holding at most a fixed number of items, backed
+// by a buffered channel. Enqueue blocks while it is full, applying backpressure
+// to producers, and Dequeue blocks while it is empty
+type BoundedQueue[T any] struct {
+	mu    sync.RWMutex // guards closing items against in-flight Enqueues
+	items chan T
+	done  chan struct{} // closed by Close to release blocked Enqueues
+	once  sync.Once
+}
+
+// NewBoundedQueue creates a queue holding up to capacity items
+func NewBoundedQueue[T any](capacity int) *BoundedQueue[T] {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &BoundedQueue[T]{
+		items: make(chan T, capacity),
+		done:  make(chan struct{}),
+	}
+}
+
+// Enqueue adds v to the back of the queue, blocking while it is full. It fails
+// if the queue is closed or ctx is done before there is room
+func (q *BoundedQueue[T]) Enqueue(ctx context.Context, v T) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	select {
+	case <-q.done:
+		return ErrQueueClosed
+	default:
+	}
+
+	select {
+	case q.items <- v:
+		return nil
+	case <-q.done:
+		return ErrQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dequeue removes the item at the front of the queue, blocking while it is
+// empty. Items left when the queue is closed can still be dequeued, after
+// which it fails with ErrQueueClosed
+func (q *BoundedQueue[T]) Dequeue(ctx context.Context) (T, error) {
+	select {
+	case v, ok := <-q.items:
+		if !ok {
+			var zero T
+			return zero, ErrQueueClosed
+		}
+		return v, nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Len returns the number of items waiting in the queue
+func (q *BoundedQueue[T]) Len() int {
+	return len(q.items)
+}
+
+// Close stops the queue accepting items, waking any blocked Dequeue once the
+// remaining items are drained. Enqueues blocked on a full queue fail with
+// ErrQueueClosed rather than being waited on, so Close never depends on
+// consumers making room. It is safe to call more than once
+func (q *BoundedQueue[T]) Close() {
+	q.once.Do(func() {
+		close(q.done)
+
+		// items is only closed once the released Enqueues have returned, so
+		// none of them can send on it afterwards
+		q.mu.Lock()
+		close(q.items)
+		q.mu.Unlock()
+	})
+}
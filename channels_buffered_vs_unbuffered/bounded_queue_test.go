@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBoundedQueueBlocksWhileFull(t *testing.T) {
+	q := NewBoundedQueue[int](1)
+	if err := q.Enqueue(context.Background(), 1); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	enqueued := make(chan error, 1)
+	go func() {
+		enqueued <- q.Enqueue(context.Background(), 2)
+	}()
+	select {
+	case err := <-enqueued:
+		t.Fatalf("Enqueue into a full queue returned %v, want it to block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if v, err := q.Dequeue(context.Background()); err != nil || v != 1 {
+		t.Fatalf("Dequeue: got %d, %v, want 1", v, err)
+	}
+	if err := <-enqueued; err != nil {
+		t.Fatalf("Enqueue once there was room: %v", err)
+	}
+}
+
+func TestBoundedQueueRespectsContext(t *testing.T) {
+	q := NewBoundedQueue[int](1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Dequeue(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dequeue from an empty queue: got %v, want DeadlineExceeded", err)
+	}
+
+	_ = q.Enqueue(context.Background(), 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Enqueue(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Enqueue into a full queue: got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestBoundedQueueDrainsAfterClose(t *testing.T) {
+	q := NewBoundedQueue[int](2)
+	_ = q.Enqueue(context.Background(), 1)
+	_ = q.Enqueue(context.Background(), 2)
+
+	// a producer blocked on the full queue is released by Close rather than
+	// holding it up
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- q.Enqueue(context.Background(), 3)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		q.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited on a producer blocked on a full queue")
+	}
+	if err := <-blocked; !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("blocked Enqueue: got %v, want ErrQueueClosed", err)
+	}
+	if err := q.Enqueue(context.Background(), 4); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("Enqueue after Close: got %v, want ErrQueueClosed", err)
+	}
+
+	for _, want := range []int{1, 2} {
+		if v, err := q.Dequeue(context.Background()); err != nil || v != want {
+			t.Fatalf("Dequeue after Close: got %d, %v, want %d", v, err, want)
+		}
+	}
+	if _, err := q.Dequeue(context.Background()); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("Dequeue once drained: got %v, want ErrQueueClosed", err)
+	}
+}
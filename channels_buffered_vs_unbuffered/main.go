@@ -1,15 +1,26 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
-	"strings"
+	"os/signal"
 	"sync"
 	"time"
 )
 
+// verbose turns on the running commentary of each send and file processed
+var verbose = true
+
+// sizeUnit is how long processing takes for each unit of a file's size
+var sizeUnit = time.Second
+
 func main() {
+	flag.BoolVar(&verbose, "verbose", verbose, "print each file as it is sent and processed")
+	flag.Parse()
+
 	if err := run(); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
@@ -84,23 +95,32 @@ General Guidelines
 */
 
 func run() error {
+	// stop early on ctrl+c, letting workers finish the file they're on
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	// generate a list of test files with random processing times
 	files := generateLargeFileList(200)
 
-	// run both channel types and store their execution times
-	var times []time.Duration
+	// run both channel types with a few worker counts, as more workers
+	// drain the channel faster and leave the buffer less to absorb
+	for _, workers := range []int{3, 6} {
+		var times []time.Duration
 
-	fmt.Println("\n=== Unbuffered Channel ===")
-	times = append(times, processFiles(files, make(chan string)))
+		fmt.Printf("\n=== Unbuffered Channel, %d Workers ===\n", workers)
+		elapsed, _ := processFiles(ctx, files, make(chan FileInfo), workers)
+		times = append(times, elapsed)
 
-	fmt.Println("\n=== Buffered Channel ===")
-	times = append(times, processFiles(files, make(chan string, 5))) // buffer of 5 files
+		fmt.Printf("\n=== Buffered Channel, %d Workers ===\n", workers)
+		elapsed, _ = processFiles(ctx, files, make(chan FileInfo, 5), workers) // buffer of 5 files
+		times = append(times, elapsed)
 
-	// compare the results
-	fmt.Println("\n=== Performance Comparison ===")
-	fmt.Printf("Unbuffered Channel Total Time: %v\n", times[0])
-	fmt.Printf("Buffered Channel Total Time: %v\n", times[1])
-	fmt.Printf("Difference: %v\n", times[1]-times[0])
+		// compare the results
+		fmt.Printf("\n=== Performance Comparison, %d Workers ===\n", workers)
+		fmt.Printf("Unbuffered Channel Total Time: %v\n", times[0])
+		fmt.Printf("Buffered Channel Total Time: %v\n", times[1])
+		fmt.Printf("Difference: %v\n", times[1]-times[0])
+	}
 
 	return nil
 }
@@ -110,67 +130,133 @@ type FileInfo struct {
 	size int
 }
 
+// FileResult records which worker processed a file and how long it took
+type FileResult struct {
+	Name     string
+	Size     int
+	Worker   int
+	Duration time.Duration
+}
+
 func generateLargeFileList(count int) []FileInfo {
 	files := make([]FileInfo, count)
-	rand.NewSource(time.Now().UnixNano())
+	r := rand.New(rand.NewSource(time.Now().UnixNano())) // sizes differ on every run
 
 	for i := 0; i < count; i++ {
 		files[i] = FileInfo{
 			name: fmt.Sprintf("file%d.txt", i+1),
-			size: rand.Intn(3) + 1,
+			size: r.Intn(3) + 1,
 		}
 	}
 	return files
 }
 
-func processFiles(files []FileInfo, ch chan string) time.Duration {
+// processFiles sends files over ch to the given number of workers, at least
+// one, returning how long they took to process them all along with a result
+// for each file processed. Cancelling ctx stops any more files being sent or
+// picked up, and returns once workers finish the file they're on
+func processFiles(ctx context.Context, files []FileInfo, ch chan FileInfo, workers int) (time.Duration, []FileResult) {
+	if workers < 1 {
+		workers = 1
+	}
 	startTime := time.Now()
 	var wg sync.WaitGroup
 
+	// room for every file, so workers never block on reporting a result
+	results := make(chan FileResult, len(files))
+
 	// start multiple worker goroutines to process files
-	for w := 0; w < 3; w++ {
+	for w := 0; w < workers; w++ {
 		wg.Add(1)
-		go func(workerID int) {
+		// workers only ever receive, so take the channel as receive-only
+		go func(workerID int, inbound <-chan FileInfo) {
 			defer wg.Done()
 
-			// worker keeps taking files from channel until it's closed
-			for fileName := range ch {
-				fileIndex := strings.Index(fileName, "file")
-				fileInfo := files[fileIndex]
+			// worker keeps taking files from channel until it's closed, or
+			// processing is cancelled
+			for {
+				var fileInfo FileInfo
+				select {
+				case <-ctx.Done():
+					return
+				case next, ok := <-inbound:
+					if !ok {
+						return
+					}
+					fileInfo = next
+				}
 
-				fmt.Printf("[%v] Worker %d starting %s (size: %ds)\n",
-					time.Since(startTime), workerID, fileName, fileInfo.size)
+				logf("[%v] Worker %d starting %s (size: %ds)\n",
+					time.Since(startTime), workerID, fileInfo.name, fileInfo.size)
 
 				// simulate file processing with sleep
-				time.Sleep(time.Duration(fileInfo.size) * time.Second)
+				fileStart := time.Now()
+				time.Sleep(time.Duration(fileInfo.size) * sizeUnit)
 
-				fmt.Printf("[%v] Worker %d completed %s\n",
-					time.Since(startTime), workerID, fileName)
+				results <- FileResult{
+					Name:     fileInfo.name,
+					Size:     fileInfo.size,
+					Worker:   workerID,
+					Duration: time.Since(fileStart),
+				}
+				logf("[%v] Worker %d completed %s\n",
+					time.Since(startTime), workerID, fileInfo.name)
 			}
-		}(w)
+		}(w, ch)
 	}
 
-	// producer goroutine - sends files to the channel
-	go func() {
+	// producer goroutine - sends files to the channel, so takes it as send-only.
+	// it's waited on along with the workers, as once cancelled it can still be
+	// running after they have all returned
+	wg.Add(1)
+	go func(outbound chan<- FileInfo) {
+		defer wg.Done()
 		for _, file := range files {
 			sendStart := time.Now()
-			fmt.Printf("[%v] Attempting to send %s (size: %ds) to channel\n",
+			logf("[%v] Attempting to send %s (size: %ds) to channel\n",
 				time.Since(startTime), file.name, file.size)
 
-			ch <- file.name // this will block if channel is unbuffered, or buffer is full
+			// this will block if channel is unbuffered, or buffer is full
+			select {
+			case outbound <- file:
+			case <-ctx.Done():
+				logf("[%v] Cancelled, closing channel without sending %s\n",
+					time.Since(startTime), file.name)
+				close(outbound)
+				return
+			}
 
-			fmt.Printf("[%v] Finished sending %s (took: %v)\n",
+			logf("[%v] Finished sending %s (took: %v)\n",
 				time.Since(startTime), file.name, time.Since(sendStart))
 		}
 
 		// close the channel to signal that no more files are coming
-		fmt.Printf("[%v] All files sent, closing channel\n", time.Since(startTime))
-		close(ch)
-	}()
+		logf("[%v] All files sent, closing channel\n", time.Since(startTime))
+		close(outbound)
+	}(ch)
 
+	// warn, rather than hang silently, if the workers look to be stuck
+	if stallTimeout > 0 && !waitWithTimeout(&wg, stallTimeout) {
+		fmt.Printf("[%v] Warning: workers still running after %v, possible deadlock\n",
+			time.Since(startTime), stallTimeout)
+		dumpStacks()
+	}
 	wg.Wait()
+	close(results)
 
 	executionTime := time.Since(startTime)
-	fmt.Printf("\nExecution completed in %v\n", executionTime)
-	return executionTime
+	logf("\nExecution completed in %v\n", executionTime)
+
+	processed := make([]FileResult, 0, len(files))
+	for result := range results {
+		processed = append(processed, result)
+	}
+	return executionTime, processed
+}
+
+// logf prints only when running verbosely
+func logf(format string, args ...any) {
+	if verbose {
+		fmt.Printf(format, args...)
+	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// quickly makes processFiles take a millisecond rather than a second per
+// unit of file size, without printing, until the test ends
+func quickly(t *testing.T) {
+	t.Helper()
+
+	unit, wasVerbose := sizeUnit, verbose
+	sizeUnit, verbose = time.Millisecond, false
+	t.Cleanup(func() {
+		sizeUnit, verbose = unit, wasVerbose
+	})
+}
+
+func TestProcessFilesReportsEachFilesSize(t *testing.T) {
+	quickly(t)
+
+	files := generateLargeFileList(30)
+	_, results := processFiles(context.Background(), files, make(chan FileInfo), 3)
+
+	sizes := make(map[string]int, len(files))
+	for _, file := range files {
+		sizes[file.name] = file.size
+	}
+	for _, result := range results {
+		if want := sizes[result.Name]; result.Size != want {
+			t.Errorf("%s: reported size %d, want %d", result.Name, result.Size, want)
+		}
+	}
+}
+
+func TestGenerateLargeFileListDiffersBetweenCalls(t *testing.T) {
+	// sizes are drawn from a freshly seeded source on each call, so two lists
+	// of 200 files match only with a chance of 3^-200
+	first, second := generateLargeFileList(200), generateLargeFileList(200)
+	if slices.Equal(first, second) {
+		t.Fatal("two generated lists are identical, want sizes to differ between calls")
+	}
+}
+
+func TestProcessFilesStopsWhenCancelled(t *testing.T) {
+	quickly(t)
+
+	// one worker takes at least 200ms over these, so most are never reached
+	files := generateLargeFileList(200)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, results := processFiles(ctx, files, make(chan FileInfo), 1)
+	if len(results) >= len(files) {
+		t.Fatalf("processed %d of %d files, want processing to stop early", len(results), len(files))
+	}
+}
+
+func TestProcessFilesProcessesAllFilesForAnyWorkerCount(t *testing.T) {
+	quickly(t)
+
+	files := generateLargeFileList(30)
+	for _, workers := range []int{0, 1, 3, 10} {
+		for _, ch := range []chan FileInfo{make(chan FileInfo), make(chan FileInfo, 5)} {
+			_, results := processFiles(context.Background(), files, ch, workers)
+			if len(results) != len(files) {
+				t.Errorf("%d workers, buffer %d: processed %d files, want %d",
+					workers, cap(ch), len(results), len(files))
+			}
+		}
+	}
+}
+
+func TestProcessFilesResultsHaveEachFileOnce(t *testing.T) {
+	quickly(t)
+
+	files := generateLargeFileList(30)
+	_, results := processFiles(context.Background(), files, make(chan FileInfo, 5), 3)
+
+	seen := make(map[string]int, len(results))
+	for _, result := range results {
+		seen[result.Name]++
+	}
+	for _, file := range files {
+		if seen[file.name] != 1 {
+			t.Errorf("%s: appears %d times in the results, want 1", file.name, seen[file.name])
+		}
+	}
+	if len(results) != len(files) {
+		t.Errorf("got %d results, want %d", len(results), len(files))
+	}
+}
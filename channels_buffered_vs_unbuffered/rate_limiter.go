@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket built on a buffered channel. The buffer holds
+// the available tokens, so its capacity is the largest burst allowed, and each
+// token taken is put back once the rate's duration has passed. Tokens are
+// never created, only returned, so no window of that duration ever sees more
+// calls than the rate
+type RateLimiter struct {
+	tokens chan struct{}
+	per    time.Duration
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// NewRateLimiter allows rate calls per the given duration, starting with a
+// full bucket. Call Stop once done with it to stop tokens being returned
+func NewRateLimiter(rate int, per time.Duration) *RateLimiter {
+	if rate < 1 {
+		rate = 1
+	}
+
+	limiter := &RateLimiter{
+		tokens: make(chan struct{}, rate),
+		per:    per,
+		stop:   make(chan struct{}),
+	}
+	for i := 0; i < rate; i++ {
+		limiter.tokens <- struct{}{}
+	}
+	return limiter
+}
+
+// release returns a token to the bucket, unless the limiter has been stopped.
+// Every token taken is returned exactly once, so the bucket always has room
+func (limiter *RateLimiter) release() {
+	select {
+	case <-limiter.stop:
+	default:
+		limiter.tokens <- struct{}{}
+	}
+}
+
+// Wait blocks until a token is available or ctx is done
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-limiter.tokens:
+		time.AfterFunc(limiter.per, limiter.release)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop halts the returning of tokens, and is safe to call more than once
+func (limiter *RateLimiter) Stop() {
+	limiter.once.Do(func() {
+		close(limiter.stop)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterStaysWithinRate(t *testing.T) {
+	const rate, per = 5, 200 * time.Millisecond
+	limiter := NewRateLimiter(rate, per)
+	defer limiter.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*per)
+	defer cancel()
+
+	// each call's token is taken somewhere between when it started waiting
+	// and when it returned
+	var waited, granted []time.Time
+	for {
+		start := time.Now()
+		if limiter.Wait(ctx) != nil {
+			break
+		}
+		waited, granted = append(waited, start), append(granted, time.Now())
+	}
+
+	// any rate+1 consecutive calls must span at least a full window
+	for i := rate; i < len(granted); i++ {
+		if span := granted[i].Sub(waited[i-rate]); span < per {
+			t.Fatalf("calls %d to %d made within %s, want no more than %d per %s", i-rate, i, span, rate, per)
+		}
+	}
+	if len(granted) < rate {
+		t.Fatalf("only %d calls allowed, want at least the initial burst of %d", len(granted), rate)
+	}
+}
+
+func TestRateLimiterStopTwice(t *testing.T) {
+	limiter := NewRateLimiter(1, time.Second)
+	limiter.Stop()
+	limiter.Stop() // must not panic
+}
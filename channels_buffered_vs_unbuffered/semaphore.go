@@ -0,0 +1,42 @@
+package main
+
+import "context"
+
+// Semaphore limits how much work is in flight at once, using a buffered
+// channel whose capacity is the limit. Acquiring sends into the buffer, so
+// blocks once it is full, and releasing receives from it to make room again
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// NewSemaphore creates a semaphore allowing up to n concurrent holders
+func NewSemaphore(n int) *Semaphore {
+	if n < 1 {
+		n = 1
+	}
+
+	return &Semaphore{
+		slots: make(chan struct{}, n),
+	}
+}
+
+// Acquire takes a slot, blocking while all are held, and fails if ctx is done
+// before one is free
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire. Releasing more slots than have been
+// acquired panics, as it points to a bug in the caller
+func (s *Semaphore) Release() {
+	select {
+	case <-s.slots:
+	default:
+		panic("semaphore released more times than acquired")
+	}
+}
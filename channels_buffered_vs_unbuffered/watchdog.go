@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// stallTimeout is how long processFiles waits for its workers before warning
+// that they may be deadlocked, zero disables the warning. Buffered channels can
+// hide a deadlock until the buffer fills, so this is well above how long a run
+// should take rather than a limit on it
+var stallTimeout = 5 * time.Minute
+
+// waitWithTimeout waits for wg, reporting false if it is still waiting after
+// d. The goroutine waiting on wg is left running in that case, so it ends
+// whenever wg does, or leaks along with a genuinely deadlocked wg
+func waitWithTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// dumpStacks writes the stack of every goroutine to stderr, to show where a
+// stalled run is blocked
+func dumpStacks() {
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	_, _ = fmt.Fprintf(os.Stderr, "%s\n", buf[:n])
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitWithTimeoutFiresOnStall(t *testing.T) {
+	var wg sync.WaitGroup
+	ch := make(chan FileInfo) // unbuffered, and nothing sends until the end
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ch
+	}()
+
+	if waitWithTimeout(&wg, 20*time.Millisecond) {
+		t.Fatal("got true while the worker is blocked, want the watchdog to fire")
+	}
+
+	// unblock the worker, after which the wait completes
+	ch <- FileInfo{}
+	if !waitWithTimeout(&wg, time.Second) {
+		t.Fatal("got false once the worker finished, want true")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrPoolClosed is returned when submitting to a WorkerPool after Shutdown
+var ErrPoolClosed = errors.New("worker pool has been shut down")
+
+// WorkerPool runs fn over submitted items using a fixed number of worker
+// goroutines, fed by a buffered channel holding one pending item per worker
+type WorkerPool[T any] struct {
+	mu     sync.RWMutex // guards closing jobs against in-flight Submits
+	jobs   chan T
+	ctx    context.Context
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// NewWorkerPool starts the workers, which run until Shutdown is called or ctx
+// is cancelled, whichever comes first
+func NewWorkerPool[T any](ctx context.Context, workers int, fn func(T)) *WorkerPool[T] {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pool := &WorkerPool[T]{
+		jobs: make(chan T, workers),
+		ctx:  ctx,
+	}
+
+	pool.wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(jobs <-chan T) {
+			defer pool.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item, ok := <-jobs:
+					if !ok {
+						return
+					}
+					fn(item)
+				}
+			}
+		}(pool.jobs)
+	}
+
+	return pool
+}
+
+// Submit queues an item for processing, blocking while the buffer is full.
+// It fails if the pool has been shut down or its context is cancelled
+func (pool *WorkerPool[T]) Submit(item T) error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	if pool.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case pool.jobs <- item:
+		return nil
+	case <-pool.ctx.Done():
+		return pool.ctx.Err()
+	}
+}
+
+// Shutdown stops accepting items and waits for the workers to finish what has
+// already been submitted, or to stop early if the context is cancelled
+func (pool *WorkerPool[T]) Shutdown() {
+	pool.mu.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.jobs)
+	}
+	pool.mu.Unlock()
+
+	pool.wg.Wait()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolProcessesEachJobOnce(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		processed = make(map[int]int)
+	)
+	pool := NewWorkerPool(context.Background(), 4, func(job int) {
+		mu.Lock()
+		processed[job]++
+		mu.Unlock()
+	})
+
+	for job := 0; job < 100; job++ {
+		if err := pool.Submit(job); err != nil {
+			t.Fatalf("Submit %d: %v", job, err)
+		}
+	}
+	pool.Shutdown()
+
+	if len(processed) != 100 {
+		t.Fatalf("processed %d distinct jobs, want 100", len(processed))
+	}
+	for job, times := range processed {
+		if times != 1 {
+			t.Errorf("job %d processed %d times", job, times)
+		}
+	}
+
+	if err := pool.Submit(100); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Submit after Shutdown: got %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestWorkerPoolStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewWorkerPool(ctx, 1, func(int) {
+		<-ctx.Done() // the single worker is stuck until cancelled
+	})
+
+	if err := pool.Submit(1); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		pool.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after the context was cancelled")
+	}
+	if err := pool.Submit(2); err == nil {
+		t.Fatal("Submit after cancellation: want an error")
+	}
+}
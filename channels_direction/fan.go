@@ -0,0 +1,82 @@
+package main
+
+import "sync"
+
+// FanIn merges any number of receive-only channels into a single one. Each
+// input gets its own goroutine forwarding into the output, and the output is
+// only closed once every input has been drained and closed
+func FanIn[T any](inputs ...<-chan T) <-chan T {
+	out := make(chan T)
+
+	var wg sync.WaitGroup
+	wg.Add(len(inputs))
+	for _, in := range inputs {
+		go func(in <-chan T) {
+			defer wg.Done()
+			for v := range in {
+				out <- v
+			}
+		}(in)
+	}
+
+	// close once all forwarders are done, so the consumer's range loop ends
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// FanOut distributes the values from a single receive-only channel across n
+// outputs. Each output is fed by its own goroutine competing to receive from
+// in, so a slow consumer on one output doesn't hold up the others. Every
+// output is closed once in is closed. An n below one is treated as one
+func FanOut[T any](in <-chan T, n int) []<-chan T {
+	if n < 1 {
+		n = 1
+	}
+
+	outputs := make([]<-chan T, n)
+	for i := range outputs {
+		out := make(chan T)
+		outputs[i] = out
+
+		// the forwarder only needs to send, so it takes the send-only side
+		go func(out chan<- T) {
+			defer close(out)
+			for v := range in {
+				out <- v
+			}
+		}(out)
+	}
+
+	return outputs
+}
+
+// Tee duplicates every value from in onto two outputs, closing both once in
+// is closed. Each value is delivered to both outputs before the next is read,
+// so no value is lost but the slower consumer sets the pace for both
+func Tee[T any](in <-chan T) (<-chan T, <-chan T) {
+	out1, out2 := make(chan T), make(chan T)
+
+	go func() {
+		defer close(out1)
+		defer close(out2)
+		for v := range in {
+			// shadow the outputs so each can be disabled, by setting it to
+			// nil, once it has received this value
+			out1, out2 := out1, out2
+			for i := 0; i < 2; i++ {
+				select {
+				case out1 <- v:
+					out1 = nil
+				case out2 <- v:
+					out2 = nil
+				}
+			}
+		}
+	}()
+
+	return out1, out2
+}
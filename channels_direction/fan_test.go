@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+// produce sends from through to-1 on a new channel, closing it afterwards
+func produce(from, to int) <-chan int {
+	out := make(chan int)
+	go func() {
+		defer close(out)
+		for v := from; v < to; v++ {
+			out <- v
+		}
+	}()
+	return out
+}
+
+func TestFanInDeliversEveryValueOnce(t *testing.T) {
+	merged := FanIn(produce(0, 10), produce(10, 20), produce(20, 30))
+
+	var got []int
+	for v := range merged {
+		got = append(got, v)
+	}
+	slices.Sort(got)
+
+	want := make([]int, 30)
+	for i := range want {
+		want[i] = i
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want each of 0 to 29 exactly once", got)
+	}
+}
+
+func TestFanOutSplitsEveryValue(t *testing.T) {
+	outputs := FanOut(produce(0, 100), 4)
+	if len(outputs) != 4 {
+		t.Fatalf("got %d outputs, want 4", len(outputs))
+	}
+
+	var (
+		mu  sync.Mutex
+		got []int
+		wg  sync.WaitGroup
+	)
+	for _, out := range outputs {
+		wg.Add(1)
+		go func(out <-chan int) {
+			defer wg.Done()
+			for v := range out {
+				mu.Lock()
+				got = append(got, v)
+				mu.Unlock()
+			}
+		}(out)
+	}
+	wg.Wait()
+	slices.Sort(got)
+
+	want := make([]int, 100)
+	for i := range want {
+		want[i] = i
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("union of outputs: got %v, want each of 0 to 99 exactly once", got)
+	}
+}
+
+func TestTeeDuplicatesTheSequence(t *testing.T) {
+	out1, out2 := Tee(produce(0, 20))
+
+	var got1, got2 []int
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for v := range out1 {
+			got1 = append(got1, v)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for v := range out2 {
+			got2 = append(got2, v)
+		}
+	}()
+	wg.Wait()
+
+	if len(got1) != 20 || !slices.Equal(got1, got2) {
+		t.Fatalf("outputs differ: %v and %v, want 0 to 19 on both", got1, got2)
+	}
+	if !slices.IsSorted(got1) {
+		t.Fatalf("output out of order: %v", got1)
+	}
+}
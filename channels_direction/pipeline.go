@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Generate sends each of values in turn, closing its output once they have
+// all been sent or ctx is cancelled, whichever comes first. It is the usual
+// source at the head of a pipeline
+func Generate[T any](ctx context.Context, values ...T) <-chan T {
+	out := make(chan T)
+
+	go func() {
+		defer close(out)
+		for _, v := range values {
+			select {
+			case out <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// OrDone forwards values from in until either in is closed or ctx is
+// cancelled, then closes its output. Ranging over the result lets a consumer
+// stop early without leaking the goroutine that feeds it
+func OrDone[T any](ctx context.Context, in <-chan T) <-chan T {
+	out := make(chan T)
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+				// the send needs guarding too, as the consumer may have gone
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// Batch groups values from in into slices of up to maxSize, sending a batch
+// once it is full or maxWait has passed since its first value arrived, so that
+// a slow trickle of values isn't held back indefinitely. Any partial batch is
+// sent when in is closed, before the output is closed
+func Batch[T any](in <-chan T, maxSize int, maxWait time.Duration) <-chan []T {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	out := make(chan []T)
+
+	go func() {
+		defer close(out)
+
+		var batch []T
+		var timer *time.Timer
+		var timeout <-chan time.Time // nil, and so never ready, while batch is empty
+
+		flush := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+			timeout = nil
+			out <- batch
+			batch = nil
+		}
+
+		for {
+			select {
+			case v, ok := <-in:
+				if !ok {
+					if len(batch) > 0 {
+						flush()
+					}
+					return
+				}
+				if len(batch) == 0 {
+					timer = time.NewTimer(maxWait)
+					timeout = timer.C
+				}
+				batch = append(batch, v)
+				if len(batch) >= maxSize {
+					flush()
+				}
+			case <-timeout:
+				flush()
+			}
+		}
+	}()
+
+	return out
+}
+
+// Map sends fn applied to each value from in, in the order they arrived,
+// closing its output once in is closed
+func Map[T, U any](in <-chan T, fn func(T) U) <-chan U {
+	out := make(chan U)
+
+	go func() {
+		defer close(out)
+		for v := range in {
+			out <- fn(v)
+		}
+	}()
+
+	return out
+}
+
+// MapConcurrent is Map with fn run across the given number of goroutines, for
+// when fn is slow. Results are sent as soon as they are ready, so the output
+// order is not preserved
+func MapConcurrent[T, U any](in <-chan T, workers int, fn func(T) U) <-chan U {
+	if workers < 1 {
+		workers = 1
+	}
+	out := make(chan U)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for v := range in {
+				out <- fn(v)
+			}
+		}()
+	}
+
+	// close only once every worker has sent its last result
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// Filter sends only the values from in for which pred returns true, closing
+// its output once in is closed
+func Filter[T any](in <-chan T, pred func(T) bool) <-chan T {
+	out := make(chan T)
+
+	go func() {
+		defer close(out)
+		for v := range in {
+			if pred(v) {
+				out <- v
+			}
+		}
+	}()
+
+	return out
+}
+
+// Drain receives and discards values from ch until it is closed, returning
+// how many were discarded. It blocks until then, so ch must be closed by its
+// sender at some point
+func Drain[T any](ch <-chan T) int {
+	count := 0
+	for range ch {
+		count++
+	}
+	return count
+}
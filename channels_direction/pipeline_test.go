@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOrDoneClosesWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan int) // never sent on or closed
+	out := OrDone(ctx, in)
+
+	cancel()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatal("got a value, want the output closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("output still open a second after cancelling")
+	}
+}
+
+func TestOrDoneForwardsUntilInCloses(t *testing.T) {
+	in := make(chan int, 3)
+	in <- 1
+	in <- 2
+	in <- 3
+	close(in)
+
+	var got []int
+	for v := range OrDone(context.Background(), in) {
+		got = append(got, v)
+	}
+	if !slices.Equal(got, []int{1, 2, 3}) {
+		t.Fatalf("got %v, want [1 2 3]", got)
+	}
+}
+
+func TestBatchFlushesWhenFull(t *testing.T) {
+	in := make(chan int)
+	go func() {
+		defer close(in)
+		for v := 1; v <= 7; v++ {
+			in <- v
+		}
+	}()
+
+	var got [][]int
+	for batch := range Batch(in, 3, time.Hour) {
+		got = append(got, batch)
+	}
+
+	// the partial batch left when in closes is still sent
+	want := [][]int{{1, 2, 3}, {4, 5, 6}, {7}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestBatchFlushesAfterMaxWait(t *testing.T) {
+	in := make(chan int)
+	defer close(in)
+	out := Batch(in, 100, 20*time.Millisecond)
+
+	in <- 1
+	in <- 2
+	select {
+	case batch := <-out:
+		if !slices.Equal(batch, []int{1, 2}) {
+			t.Fatalf("got %v, want [1 2]", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial batch not sent after maxWait")
+	}
+}
+
+func TestMapSquaresInOrder(t *testing.T) {
+	var got []int
+	for v := range Map(Generate(context.Background(), 1, 2, 3, 4), func(v int) int { return v * v }) {
+		got = append(got, v)
+	}
+	if want := []int{1, 4, 9, 16}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestMapConcurrentSquaresEveryValue(t *testing.T) {
+	var got []int
+	for v := range MapConcurrent(Generate(context.Background(), 1, 2, 3, 4), 3, func(v int) int { return v * v }) {
+		got = append(got, v)
+	}
+
+	// results arrive as each worker finishes, so only the set is fixed
+	slices.Sort(got)
+	if want := []int{1, 4, 9, 16}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v in any order", got, want)
+	}
+}
+
+func TestFilterKeepsEvenNumbers(t *testing.T) {
+	var got []int
+	for v := range Filter(produce(1, 11), func(v int) bool { return v%2 == 0 }) {
+		got = append(got, v)
+	}
+	if want := []int{2, 4, 6, 8, 10}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestDrainCountsDiscardedValues(t *testing.T) {
+	ch := make(chan int, 5)
+	for v := range 5 {
+		ch <- v
+	}
+	close(ch)
+
+	if got := Drain(ch); got != 5 {
+		t.Fatalf("got %d, want 5", got)
+	}
+}
+
+func TestGenerateSendsEachValue(t *testing.T) {
+	values := []string{"a", "b", "c"}
+
+	var got []string
+	for v := range Generate(context.Background(), values...) {
+		got = append(got, v)
+	}
+	if !slices.Equal(got, values) {
+		t.Fatalf("got %v, want %v", got, values)
+	}
+}
+
+func TestGenerateStopsWhenCancelled(t *testing.T) {
+	values := make([]int, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := Generate(ctx, values...)
+
+	<-out
+	cancel()
+
+	// a select picks at random between a ready send and ctx.Done, so a few
+	// more values may slip through, but never the rest of the thousand
+	received := 1
+	for range out {
+		received++
+	}
+	if received == len(values) {
+		t.Fatalf("got all %d values, want Generate to stop once cancelled", received)
+	}
+}
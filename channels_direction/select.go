@@ -0,0 +1,100 @@
+package main
+
+import "time"
+
+// TrySend attempts to send v without blocking, returning false if the send
+// would have blocked because there is no ready receiver or the buffer is full
+func TrySend[T any](ch chan<- T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+// TryReceive attempts to receive without blocking, returning false if there
+// is nothing ready to receive or the channel is closed
+func TryReceive[T any](ch <-chan T) (T, bool) {
+	select {
+	case v, ok := <-ch:
+		return v, ok
+	default:
+		var zero T
+		return zero, false
+	}
+}
+
+// ReceiveTimeout waits up to d for a value from ch, returning false if none
+// arrives in time or ch is closed. It uses its own timer rather than
+// time.After, so that the timer is stopped as soon as a value arrives
+func ReceiveTimeout[T any](ch <-chan T, d time.Duration) (T, bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case v, ok := <-ch:
+		return v, ok
+	case <-timer.C:
+		var zero T
+		return zero, false
+	}
+}
+
+// SafeSend sends v, blocking as a normal send would, but returns false rather
+// than panicking if ch has been closed. This is a pragmatic guard for code
+// where ownership of ch is unclear, not a substitute for making sure only the
+// sender closes a channel, and only once it has finished sending
+func SafeSend[T any](ch chan<- T, v T) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	ch <- v
+	return true
+}
+
+// SelectPriority merges high and low into one channel, always sending
+// anything ready on high before taking from low. A lone select picks at random
+// between ready cases, so high is first checked on its own, falling through to
+// waiting on both only when it has nothing ready. The output is closed once
+// both inputs are closed
+func SelectPriority[T any](high, low <-chan T) <-chan T {
+	out := make(chan T)
+
+	go func() {
+		defer close(out)
+		// closed inputs are set to nil, which is never ready in a select
+		for high != nil || low != nil {
+			select {
+			case v, ok := <-high:
+				if !ok {
+					high = nil
+					continue
+				}
+				out <- v
+				continue
+			default:
+			}
+
+			select {
+			case v, ok := <-high:
+				if !ok {
+					high = nil
+					continue
+				}
+				out <- v
+			case v, ok := <-low:
+				if !ok {
+					low = nil
+					continue
+				}
+				out <- v
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTrySendOnFullBuffer(t *testing.T) {
+	ch := make(chan int, 1)
+	if !TrySend(ch, 1) {
+		t.Fatal("TrySend into an empty buffer: got false")
+	}
+	if TrySend(ch, 2) {
+		t.Fatal("TrySend into a full buffer: got true")
+	}
+}
+
+func TestTryReceiveOnEmptyChannel(t *testing.T) {
+	ch := make(chan int, 1)
+	if _, ok := TryReceive(ch); ok {
+		t.Fatal("TryReceive from an empty channel: got true")
+	}
+
+	ch <- 1
+	if v, ok := TryReceive(ch); !ok || v != 1 {
+		t.Fatalf("TryReceive with a value waiting: got %d, %t, want 1, true", v, ok)
+	}
+
+	close(ch)
+	if _, ok := TryReceive(ch); ok {
+		t.Fatal("TryReceive from a closed channel: got true")
+	}
+}
+
+func TestSafeSendOnClosedChannel(t *testing.T) {
+	ch := make(chan int, 1)
+	if !SafeSend(ch, 1) {
+		t.Fatal("SafeSend on an open channel: got false")
+	}
+
+	close(ch)
+	if SafeSend(ch, 2) {
+		t.Fatal("SafeSend on a closed channel: got true")
+	}
+}
+
+func TestSelectPriorityPrefersHigh(t *testing.T) {
+	high, low := make(chan string, 3), make(chan string, 3)
+	for i := range 3 {
+		low <- fmt.Sprintf("low%d", i)
+		high <- fmt.Sprintf("high%d", i)
+	}
+	close(high)
+	close(low)
+
+	// both are ready throughout, so every high item comes out first
+	var got []string
+	for v := range SelectPriority(high, low) {
+		got = append(got, v)
+	}
+	want := []string{"high0", "high1", "high2", "low0", "low1", "low2"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestReceiveTimeoutGetsValue(t *testing.T) {
+	ch := make(chan int)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ch <- 7
+	}()
+
+	if v, ok := ReceiveTimeout(ch, time.Second); !ok || v != 7 {
+		t.Fatalf("got %d, %t, want 7, true", v, ok)
+	}
+}
+
+func TestReceiveTimeoutTimesOut(t *testing.T) {
+	ch := make(chan int) // never sent on
+
+	start := time.Now()
+	if v, ok := ReceiveTimeout(ch, 20*time.Millisecond); ok || v != 0 {
+		t.Fatalf("got %d, %t, want 0, false", v, ok)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Fatalf("returned after %v, want at least 20ms", waited)
+	}
+}